@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kong"
+	"github.com/bluekeyes/go-gitdiff/gitdiff"
+)
+
+// checkPatchPaths makes sure every file of a patch is inside the project, patches come from
+// contributors through the editor and are applied to the project root
+func checkPatchPaths(c Config, files []*gitdiff.File) error {
+	if len(files) == 0 {
+		return errors.New("the patch doesn't change any files")
+	}
+	targets := make(map[string]bool)
+	for _, f := range files {
+		for _, name := range []string{f.OldName, f.NewName} {
+			if name == "" {
+				continue
+			}
+			if !filepath.IsLocal(filepath.FromSlash(name)) {
+				return fmt.Errorf("%s is outside of the project", name)
+			}
+			// the patch may come from anyone, it can't touch the config, the cache or anything else
+			if !isPageSource(c, filepath.FromSlash(name)) {
+				return fmt.Errorf("%s is not a page in doc_dirs, only pages can be patched", name)
+			}
+		}
+		if f.NewMode&0111 != 0 {
+			return fmt.Errorf("%s would be made executable", cmp.Or(f.NewName, f.OldName))
+		}
+		target := cmp.Or(f.NewName, f.OldName)
+		if targets[target] {
+			return fmt.Errorf("%s is changed more than once", target)
+		}
+		targets[target] = true
+	}
+	return nil
+}
+
+// patchSummary is the line the preview shows for a file of a patch
+func patchSummary(f *gitdiff.File) string {
+	var added, removed int64
+	for _, frag := range f.TextFragments {
+		added += frag.LinesAdded
+		removed += frag.LinesDeleted
+	}
+	stat := fmt.Sprintf("(+%d -%d)", added, removed)
+
+	switch {
+	case f.IsNew:
+		return fmt.Sprintf("new      %s %s", f.NewName, stat)
+	case f.IsDelete:
+		return fmt.Sprintf("deleted  %s %s", f.OldName, stat)
+	case f.IsRename:
+		return fmt.Sprintf("renamed  %s -> %s %s", f.OldName, f.NewName, stat)
+	default:
+		return fmt.Sprintf("modified %s %s", f.NewName, stat)
+	}
+}
+
+// previewPatch prints which files a patch changes, then the changes to each of them
+func previewPatch(w io.Writer, files []*gitdiff.File) {
+	fmt.Fprintf(w, "The patch changes %d file(s):\n", len(files))
+	for _, f := range files {
+		fmt.Fprintln(w, "  "+patchSummary(f))
+	}
+	for _, f := range files {
+		fmt.Fprintf(w, "\n%s\n%s\n", patchSummary(f), strings.Repeat("-", 60))
+		if f.IsBinary {
+			fmt.Fprintln(w, "(binary file)")
+		} else if len(f.TextFragments) == 0 {
+			fmt.Fprintln(w, "(content unchanged)")
+		}
+		for _, frag := range f.TextFragments {
+			fmt.Fprint(w, frag.String())
+		}
+	}
+	fmt.Fprintln(w)
+}
+
+type applyStatus string
+
+const (
+	applyClean      applyStatus = "applied"
+	applyFuzzed     applyStatus = "fuzzed"     // some hunks were found away from where the patch put them
+	applyConflicted applyStatus = "conflicted" // some hunks couldn't be placed at all
+)
+
+type applyOptions struct {
+	Dry    bool // check the patch and report what would happen without changing anything
+	Fuzz   int  // lines of context at each end of a hunk that may be ignored to place it
+	Reject bool // write hunks that can't be placed to .rej files instead of conflict markers
+}
+
+// applyResult is what happened to one file of a patch
+type applyResult struct {
+	File     string
+	Status   applyStatus
+	Hunks    int
+	Rejected int // hunks that couldn't be placed
+}
+
+// patchContent applies f to src, if the patch doesn't match exactly because the file changed
+// since it was made, the hunks are merged into what is there now
+func patchContent(src []byte, f *gitdiff.File, opts applyOptions) ([]byte, applyStatus, []*gitdiff.TextFragment, error) {
+	// the hunks would be matched against what is between the markers and merged into them
+	if hasConflictMarkers(src) {
+		return nil, "", nil, errors.New("it has unresolved conflict markers, resolve them or run klarity apply --undo first")
+	}
+	var out bytes.Buffer
+	err := gitdiff.Apply(&out, bytes.NewReader(src), f)
+	if err == nil {
+		return out.Bytes(), applyClean, nil, nil
+	}
+	if f.IsBinary || !errors.Is(err, &gitdiff.Conflict{}) {
+		return nil, "", nil, err
+	}
+	merged, status, rejected := mergeFragments(src, f.TextFragments, opts.Fuzz, opts.Reject)
+	return merged, status, rejected, nil
+}
+
+// patchChanges works out what applying files to the project changes, without touching it
+func patchChanges(projectPath string, files []*gitdiff.File, opts applyOptions) ([]fileChange, []applyResult, error) {
+	var changes []fileChange
+	var results []applyResult
+	for _, f := range files {
+		oldPath := ""
+		if f.OldName != "" {
+			oldPath = filepath.Join(projectPath, f.OldName)
+		}
+
+		newPath := ""
+		if f.NewName != "" {
+			newPath = filepath.Join(projectPath, f.NewName)
+		}
+
+		if f.IsDelete {
+			if oldPath == "" {
+				return nil, nil, errors.New("invalid delete patch for file")
+			}
+			if _, err := os.Stat(oldPath); os.IsNotExist(err) {
+				return nil, nil, fmt.Errorf("file to delete does not exist: %s", oldPath)
+			}
+			changes = append(changes, fileChange{Path: f.OldName})
+			results = append(results, applyResult{File: f.OldName, Status: applyClean})
+			continue
+		}
+
+		if newPath == "" {
+			return nil, nil, errors.New("no target path for patch")
+		}
+		// new pages and renames from the editor never replace a page that is already there
+		if f.IsNew || (f.IsRename && oldPath != newPath) {
+			if _, err := os.Stat(newPath); err == nil {
+				return nil, nil, fmt.Errorf("%s already exists", f.NewName)
+			}
+		}
+
+		// new files are applied to an empty one
+		var src []byte
+		mode := os.FileMode(0644)
+		if !f.IsNew {
+			if oldPath == "" {
+				return nil, nil, errors.New("no source for non-new patch")
+			}
+			b, err := os.ReadFile(oldPath)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to open %s: %w", oldPath, err)
+			}
+			src = b
+			if info, err := os.Stat(oldPath); err == nil {
+				mode = info.Mode().Perm()
+			}
+		}
+		if f.NewMode != 0 {
+			mode = f.NewMode.Perm()
+		}
+
+		content, status, rejected, err := patchContent(src, f, opts)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to apply patch to %s: %w", f.NewName, err)
+		}
+		changes = append(changes, fileChange{Path: f.NewName, Content: content, Mode: mode})
+		if f.IsRename && oldPath != newPath {
+			changes = append(changes, fileChange{Path: f.OldName})
+		}
+		if opts.Reject && len(rejected) > 0 {
+			changes = append(changes, fileChange{Path: f.NewName + ".rej", Content: rejectFile(f, rejected), Mode: 0644})
+		}
+		results = append(results, applyResult{File: f.NewName, Status: status, Hunks: len(f.TextFragments), Rejected: len(rejected)})
+	}
+	return changes, results, nil
+}
+
+// applyPatch applies files to the project as one transaction, either every file is changed
+// or none is, and the change is journaled so klarity apply --undo can revert it
+func applyPatch(projectPath, name string, files []*gitdiff.File, opts applyOptions) ([]applyResult, error) {
+	changes, results, err := patchChanges(projectPath, files, opts)
+	if err != nil || opts.Dry {
+		return results, err
+	}
+	return results, commitChanges(projectPath, name, changes)
+}
+
+// printApplyResults lists what happened to every file of a patch and returns how many have conflicts
+func printApplyResults(w io.Writer, results []applyResult, opts applyOptions) int {
+	conflicts := 0
+	for _, r := range results {
+		line := fmt.Sprintf("  %-10s %s", r.Status, r.File)
+		if r.Status == applyConflicted {
+			conflicts++
+			where := "marked in the file"
+			if opts.Reject {
+				where = "see " + r.File + ".rej"
+			}
+			line += fmt.Sprintf(" (%d of %d changes, %s)", r.Rejected, r.Hunks, where)
+		}
+		fmt.Fprintln(w, line)
+	}
+	return conflicts
+}
+
+func (c *ApplyCmd) Run(ctx *kong.Context) error {
+	projectPath, err := filepath.Abs(c.Path)
+	if err != nil {
+		return err
+	}
+	if c.Fuzz < 0 {
+		return errors.New("--fuzz can't be negative")
+	}
+	cfg := ReadConfig(projectPath)
+	if c.Undo {
+		return undoApply(projectPath, c.Yes)
+	}
+	if c.Patch == "" {
+		return errors.New("no patch given, pass the patch to apply or --undo to revert the last one")
+	}
+
+	patchPath, err := filepath.Abs(c.Patch)
+	if err != nil {
+		return err
+	}
+	patchFile, err := os.Open(patchPath)
+	if err != nil {
+		return err
+	}
+	defer patchFile.Close()
+
+	// a patch from the editor can change any number of pages, they are all applied together
+	files, _, err := gitdiff.Parse(patchFile)
+	if err != nil {
+		return err
+	}
+	if err := checkPatchPaths(cfg, files); err != nil {
+		return fmt.Errorf("invalid patch: %w", err)
+	}
+
+	opts := applyOptions{Dry: true, Fuzz: c.Fuzz, Reject: c.Conflict == "reject"}
+	results, err := applyPatch(projectPath, patchPath, files, opts)
+	if err != nil {
+		return fmt.Errorf("patch does not apply: %w", err)
+	}
+
+	if !c.Yes {
+		previewPatch(os.Stdout, files)
+	}
+	if !c.Yes || c.Atomic {
+		fmt.Println("Applying the patch to the project as it is now:")
+		printApplyResults(os.Stdout, results, opts)
+		// fuzzed changes may have landed in the wrong place, only an exact fit goes through
+		if c.Atomic && slices.ContainsFunc(results, func(r applyResult) bool { return r.Status != applyClean }) {
+			return errors.New("patch does not apply exactly, nothing was changed")
+		}
+		fmt.Println()
+	}
+	if !c.Yes {
+		if !promptForConfirmation("Apply this patch?") {
+			fmt.Println("Patch application cancelled.")
+			return nil
+		}
+	}
+
+	opts.Dry = false
+	results, err = applyPatch(projectPath, patchPath, files, opts)
+	if err != nil {
+		return err
+	}
+
+	conflicts := printApplyResults(os.Stdout, results, opts)
+	if conflicts > 0 {
+		return fmt.Errorf("patch applied with conflicts in %d file(s), resolve them before building", conflicts)
+	}
+	fmt.Printf("Patch applied successfully, %d file(s) changed\n", len(files))
+	return nil
+}
+
+// undoApply reverts the last applied patch from its journal, files edited since are
+// pointed out before their edits are lost
+func undoApply(projectPath string, yes bool) error {
+	j, err := loadApplyJournal(projectPath)
+	if os.IsNotExist(err) {
+		return errors.New("there is no applied patch to undo")
+	} else if err != nil {
+		return err
+	}
+	changes, edited, err := j.undoChanges(projectPath)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Undoing %s, applied %s:\n", j.Patch, j.Time.Format(time.DateTime))
+	for _, c := range changes {
+		action := "restore"
+		if c.Content == nil {
+			action = "remove"
+		}
+		line := fmt.Sprintf("  %-8s %s", action, c.Path)
+		if slices.Contains(edited, c.Path) {
+			line += " (edited since, those edits are lost)"
+		}
+		fmt.Println(line)
+	}
+	if !yes && !promptForConfirmation("Undo this patch?") {
+		fmt.Println("Undo cancelled.")
+		return nil
+	}
+
+	if err := commitChanges(projectPath, j.Patch, changes); err != nil {
+		return err
+	}
+	// the journal now holds the undo, which isn't meant to be undone again
+	if err := os.RemoveAll(journalDir(projectPath)); err != nil {
+		return err
+	}
+	fmt.Println("Patch undone")
+	return nil
+}
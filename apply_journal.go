@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// fileChange is one file klarity apply writes or removes
+type fileChange struct {
+	Path    string // relative to the project root
+	Content []byte // nil removes the file
+	Mode    os.FileMode
+}
+
+// applyJournal records what the last klarity apply changed and keeps copies of the files it
+// replaced, so klarity apply --undo can put them back
+type applyJournal struct {
+	Patch string         `json:"patch"`
+	Time  time.Time      `json:"time"`
+	Files []journalEntry `json:"files"`
+}
+
+type journalEntry struct {
+	Path   string      `json:"path"`   // relative to the project root
+	Backup string      `json:"backup"` // copy of the file from before the patch, empty if there was none
+	Mode   os.FileMode `json:"mode"`
+	Hash   string      `json:"hash"` // what the patch wrote, empty if it removed the file
+}
+
+func journalDir(root string) string {
+	return filepath.Join(root, cacheDir, "apply")
+}
+
+func loadApplyJournal(root string) (*applyJournal, error) {
+	b, err := os.ReadFile(filepath.Join(journalDir(root), "journal.json"))
+	if err != nil {
+		return nil, err
+	}
+	var j applyJournal
+	if err := json.Unmarshal(b, &j); err != nil {
+		return nil, fmt.Errorf("invalid apply journal: %w", err)
+	}
+	return &j, nil
+}
+
+// commitChanges makes every change or none of them. New contents are staged in temporary files
+// next to where they go and the files they replace are copied into a new journal, only then is
+// anything moved into place, and if that fails part way the copies are put back.
+// The new journal replaces the one of the previous apply once every change is made, only the last
+// one can be undone, a failed commit leaves the previous one as it was
+func commitChanges(root, patch string, changes []fileChange) (err error) {
+	var created []string // directories made for new files, removed again on failure
+	defer func() {
+		if err != nil {
+			for i := len(created) - 1; i >= 0; i-- {
+				os.Remove(created[i])
+			}
+		}
+	}()
+	var staged []string
+	defer func() {
+		for _, tmp := range staged {
+			os.Remove(tmp) // already renamed into place unless something failed
+		}
+	}()
+
+	for _, c := range changes {
+		if c.Content == nil {
+			staged = append(staged, "")
+			continue
+		}
+		dir := filepath.Dir(filepath.Join(root, c.Path))
+		made, err := mkdirAllTracked(dir)
+		created = append(created, made...)
+		if err != nil {
+			return err
+		}
+		tmp, err := stageFile(dir, c.Content, c.Mode)
+		if err != nil {
+			return fmt.Errorf("failed to stage %s: %w", c.Path, err)
+		}
+		staged = append(staged, tmp)
+	}
+
+	j, dir, err := backupFiles(root, patch, changes)
+	if err != nil {
+		return err
+	}
+
+	for i, c := range changes {
+		path := filepath.Join(root, c.Path)
+		if c.Content == nil {
+			err = os.Remove(path)
+			if os.IsNotExist(err) {
+				err = nil
+			}
+		} else {
+			err = os.Rename(staged[i], path)
+		}
+		if err != nil {
+			err = fmt.Errorf("failed to change %s: %w", c.Path, err)
+			if rerr := restoreFiles(root, dir, j.Files[:i+1]); rerr != nil {
+				return errors.Join(err, fmt.Errorf("restoring the original files failed, copies are in %s: %w", dir, rerr))
+			}
+			os.RemoveAll(dir)
+			return err
+		}
+	}
+
+	if err := replaceDir(dir, journalDir(root)); err != nil {
+		os.RemoveAll(dir)
+		return fmt.Errorf("the changes were made, but saving them for --undo failed: %w", err)
+	}
+	return nil
+}
+
+// backupFiles writes a new journal with copies of every file that changes, into a temporary
+// directory next to the journal it is going to replace
+func backupFiles(root, patch string, changes []fileChange) (_ *applyJournal, _ string, err error) {
+	if err := os.MkdirAll(filepath.Join(root, cacheDir), os.ModePerm); err != nil {
+		return nil, "", err
+	}
+	if err := writeCacheIgnore(root); err != nil {
+		return nil, "", err
+	}
+	tmp, err := os.MkdirTemp(filepath.Join(root, cacheDir), "apply-*")
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(tmp)
+		}
+	}()
+	if err := os.Mkdir(filepath.Join(tmp, "backup"), os.ModePerm); err != nil {
+		return nil, "", err
+	}
+
+	j := &applyJournal{Patch: patch, Time: time.Now()}
+	for i, c := range changes {
+		e := journalEntry{Path: c.Path}
+		if c.Content != nil {
+			e.Hash = hashBytes(c.Content)
+		}
+
+		path := filepath.Join(root, c.Path)
+		if info, err := os.Stat(path); err == nil {
+			e.Backup = filepath.Join("backup", strconv.Itoa(i))
+			e.Mode = info.Mode().Perm()
+			if err := CopyFile(path, filepath.Join(tmp, e.Backup)); err != nil {
+				return nil, "", fmt.Errorf("failed to back up %s: %w", c.Path, err)
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, "", err
+		}
+		j.Files = append(j.Files, e)
+	}
+
+	b, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return nil, "", err
+	}
+	if err := os.WriteFile(filepath.Join(tmp, "journal.json"), b, 0644); err != nil {
+		return nil, "", err
+	}
+	return j, tmp, nil
+}
+
+// replaceDir moves dir to dst, the old dst is moved aside first and put back if that fails
+func replaceDir(dir, dst string) error {
+	old := dst + ".old"
+	if err := os.RemoveAll(old); err != nil {
+		return err
+	}
+	if err := os.Rename(dst, old); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(dir, dst); err != nil {
+		os.Rename(old, dst)
+		return err
+	}
+	return os.RemoveAll(old)
+}
+
+// restoreFiles puts back the files from before the patch out of the journal in dir, in reverse
+// so a renamed file is back before its new name goes away
+func restoreFiles(root, dir string, entries []journalEntry) error {
+	var errs []error
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		path := filepath.Join(root, e.Path)
+		if e.Backup == "" {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(dir, e.Backup))
+		if err == nil {
+			err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+		}
+		if err == nil {
+			var tmp string
+			if tmp, err = stageFile(filepath.Dir(path), b, e.Mode); err == nil {
+				if err = os.Rename(tmp, path); err != nil {
+					os.Remove(tmp)
+				}
+			}
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", e.Path, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// undoChanges are the changes that revert the journaled patch, and the files that were
+// edited after it was applied, which lose those edits
+func (j *applyJournal) undoChanges(root string) ([]fileChange, []string, error) {
+	var changes []fileChange
+	var edited []string
+	for _, e := range j.Files {
+		current, err := os.ReadFile(filepath.Join(root, e.Path))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, nil, err
+		}
+		if (err == nil) != (e.Hash != "") || (err == nil && hashBytes(current) != e.Hash) {
+			edited = append(edited, e.Path)
+		}
+
+		c := fileChange{Path: e.Path, Mode: e.Mode}
+		if e.Backup != "" {
+			if c.Content, err = os.ReadFile(filepath.Join(journalDir(root), e.Backup)); err != nil {
+				return nil, nil, fmt.Errorf("missing backup of %s: %w", e.Path, err)
+			}
+		}
+		changes = append(changes, c)
+	}
+	return changes, edited, nil
+}
+
+// stageFile writes b to a hidden temporary file in dir, which the dev server watcher ignores
+func stageFile(dir string, b []byte, mode os.FileMode) (string, error) {
+	tmp, err := os.CreateTemp(dir, ".klarity-*.tmp")
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// mkdirAllTracked is os.MkdirAll that returns the directories it created, outermost first
+func mkdirAllTracked(dir string) ([]string, error) {
+	var missing []string
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(d); err == nil || d == filepath.Dir(d) {
+			break
+		}
+		missing = append([]string{d}, missing...)
+	}
+	return missing, os.MkdirAll(dir, os.ModePerm)
+}
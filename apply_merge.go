@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/bluekeyes/go-gitdiff/gitdiff"
+)
+
+// conflict markers put around hunks that can't be placed, the middle section is what the patch
+// expected to find, the way git shows conflicts with merge.conflictStyle=diff3
+const (
+	conflictStart = "<<<<<<< current\n"
+	conflictBase  = "||||||| expected by the patch\n"
+	conflictSep   = "=======\n"
+	conflictEnd   = ">>>>>>> patch\n"
+)
+
+// mergeFragments applies frags to src when the file changed since the patch was made,
+// every hunk is looked for nearest to where the patch puts it, ignoring up to fuzz lines of its
+// context at each end if it doesn't match as a whole. Hunks that can't be found anywhere are returned,
+// they are left out of the file when reject is set and put in it between conflict markers otherwise
+func mergeFragments(src []byte, frags []*gitdiff.TextFragment, fuzz int, reject bool) ([]byte, applyStatus, []*gitdiff.TextFragment) {
+	lines := splitLines(src)
+	status := applyClean
+	var rejected []*gitdiff.TextFragment
+
+	var out []string
+	pos := 0   // lines before pos are already in out
+	shift := 0 // how far the hunks placed so far were from where the patch put them
+	for _, frag := range frags {
+		pre, post := fragmentLines(frag)
+		at := int(frag.OldPosition) - 1 + shift
+		if frag.OldLines == 0 {
+			// a hunk that only adds lines goes after the line it names
+			at++
+		}
+
+		found := false
+		for f := 0; f <= fuzz && !found; f++ {
+			lead, trail := min(f, int(frag.LeadingContext)), min(f, int(frag.TrailingContext))
+			if f > 0 && lead < f && trail < f {
+				break // no context left to ignore
+			}
+			match := pre[lead : len(pre)-trail]
+			if len(match) == 0 && len(pre) > 0 {
+				break // a hunk needs something to match, or it could go anywhere
+			}
+
+			want := at + lead
+			got := findLines(lines, match, want, pos)
+			if got < 0 {
+				continue
+			}
+			out = append(out, lines[pos:got]...)
+			out = append(out, post[lead:len(post)-trail]...)
+			pos = got + len(match)
+			shift += got - want
+			if (f > 0 || got != want) && status == applyClean {
+				status = applyFuzzed
+			}
+			found = true
+		}
+		if found {
+			continue
+		}
+
+		status = applyConflicted
+		rejected = append(rejected, frag)
+		if reject {
+			continue
+		}
+		// the hunk goes where the patch expected it, over as many lines as it expected to replace
+		start := min(max(at, pos), len(lines))
+		end := min(start+len(pre), len(lines))
+		out = append(out, lines[pos:start]...)
+		out = append(out, conflictStart)
+		out = appendBlock(out, lines[start:end])
+		out = append(out, conflictBase)
+		out = appendBlock(out, pre)
+		out = append(out, conflictSep)
+		out = appendBlock(out, post)
+		out = append(out, conflictEnd)
+		pos = end
+	}
+	out = append(out, lines[pos:]...)
+	return []byte(strings.Join(out, "")), status, rejected
+}
+
+// hasConflictMarkers reports if b still has conflicts marked by an earlier klarity apply, or by git
+func hasConflictMarkers(b []byte) bool {
+	for _, l := range splitLines(b) {
+		if strings.HasPrefix(l, conflictStart[:7]) || strings.HasPrefix(l, conflictEnd[:7]) {
+			return true
+		}
+	}
+	return false
+}
+
+// findLines returns where match is in lines, the closest to want at or after from, or -1
+func findLines(lines, match []string, want, from int) int {
+	last := len(lines) - len(match)
+	want = min(max(want, from), max(last, from))
+	for d := 0; want-d >= from || want+d <= last; d++ {
+		for _, i := range []int{want + d, want - d} {
+			if i >= from && i <= last && equalLines(lines[i:i+len(match)], match) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func equalLines(a, b []string) bool {
+	for i := range b {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// fragmentLines returns the lines a hunk expects to find and the lines it leaves in their place
+func fragmentLines(frag *gitdiff.TextFragment) (pre, post []string) {
+	for _, l := range frag.Lines {
+		if l.Old() {
+			pre = append(pre, l.Line)
+		}
+		if l.New() {
+			post = append(post, l.Line)
+		}
+	}
+	return pre, post
+}
+
+// splitLines splits b after every newline, so the lines join back into b
+func splitLines(b []byte) []string {
+	var lines []string
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n') + 1
+		if i == 0 {
+			i = len(b)
+		}
+		lines = append(lines, string(b[:i]))
+		b = b[i:]
+	}
+	return lines
+}
+
+// appendBlock adds lines inside conflict markers, which have to start on a line of their own
+func appendBlock(out, lines []string) []string {
+	for _, l := range lines {
+		if !strings.HasSuffix(l, "\n") {
+			l += "\n"
+		}
+		out = append(out, l)
+	}
+	return out
+}
+
+// rejectFile is the .rej file for the hunks of f that couldn't be placed
+func rejectFile(f *gitdiff.File, rejected []*gitdiff.TextFragment) []byte {
+	var b strings.Builder
+	b.WriteString("--- a/" + f.OldName + "\n")
+	b.WriteString("+++ b/" + f.NewName + "\n")
+	for _, frag := range rejected {
+		b.WriteString(frag.String())
+	}
+	return []byte(b.String())
+}
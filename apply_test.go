@@ -0,0 +1,368 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bluekeyes/go-gitdiff/gitdiff"
+)
+
+// a bundle as the editor downloads it, with a changed, a renamed and a new page
+const editorBundle = `diff --git a/docs/a.md b/docs/a.md
+--- a/docs/a.md
++++ b/docs/a.md
+@@ -1,2 +1,2 @@
+-# A
++# A edited
+ text
+diff --git a/docs/b.md b/docs/c.md
+rename from docs/b.md
+rename to docs/c.md
+diff --git a/docs/new.md b/docs/new.md
+new file mode 100644
+--- /dev/null
++++ b/docs/new.md
+@@ -0,0 +1,2 @@
++# New
++page
+`
+
+func TestApplyPatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		docs    map[string]string
+		patch   string
+		want    map[string]string // content of files after applying, empty for files that shouldn't exist
+		wantErr string
+	}{
+		{
+			name:  "editor bundle",
+			docs:  map[string]string{"docs/a.md": "# A\ntext\n", "docs/b.md": "# B\n"},
+			patch: editorBundle,
+			want:  map[string]string{"docs/a.md": "# A edited\ntext\n", "docs/b.md": "", "docs/c.md": "# B\n", "docs/new.md": "# New\npage\n"},
+		},
+		{
+			name:    "new page already exists",
+			docs:    map[string]string{"docs/a.md": "# A\ntext\n", "docs/b.md": "# B\n", "docs/new.md": "# Mine\n"},
+			patch:   editorBundle,
+			want:    map[string]string{"docs/a.md": "# A\ntext\n", "docs/new.md": "# Mine\n"},
+			wantErr: "already exists",
+		},
+		{
+			name:    "rename onto an existing page",
+			docs:    map[string]string{"docs/a.md": "# A\ntext\n", "docs/b.md": "# B\n", "docs/c.md": "# C\n"},
+			patch:   editorBundle,
+			want:    map[string]string{"docs/b.md": "# B\n", "docs/c.md": "# C\n"},
+			wantErr: "already exists",
+		},
+		{
+			name:    "conflicts left from an earlier patch",
+			docs:    map[string]string{"docs/a.md": conflictStart + "# A\n" + conflictBase + "# Old\n" + conflictSep + "# New\n" + conflictEnd + "text\n", "docs/b.md": "# B\n"},
+			patch:   editorBundle,
+			want:    map[string]string{"docs/b.md": "# B\n", "docs/new.md": ""},
+			wantErr: "unresolved conflict markers",
+		},
+		{
+			name:    "outside of the project",
+			patch:   "diff --git a/../x.md b/../x.md\nnew file mode 100644\n--- /dev/null\n+++ b/../x.md\n@@ -0,0 +1 @@\n+x\n",
+			wantErr: "outside of the project",
+		},
+		{
+			name:    "not a page",
+			patch:   "diff --git a/klarity.toml b/klarity.toml\nnew file mode 100644\n--- /dev/null\n+++ b/klarity.toml\n@@ -0,0 +1 @@\n+x\n",
+			wantErr: "not a page in doc_dirs",
+		},
+		{
+			name:    "git hook",
+			patch:   "diff --git a/.git/hooks/pre-commit b/.git/hooks/pre-commit\nnew file mode 100755\n--- /dev/null\n+++ b/.git/hooks/pre-commit\n@@ -0,0 +1 @@\n+x\n",
+			want:    map[string]string{".git/hooks/pre-commit": ""},
+			wantErr: "not a page in doc_dirs",
+		},
+		{
+			name:    "executable page",
+			patch:   "diff --git a/docs/run.md b/docs/run.md\nnew file mode 100755\n--- /dev/null\n+++ b/docs/run.md\n@@ -0,0 +1 @@\n+x\n",
+			want:    map[string]string{"docs/run.md": ""},
+			wantErr: "executable",
+		},
+		{
+			name:    "same file twice",
+			docs:    map[string]string{"docs/a.md": "# A\ntext\n"},
+			patch:   editorBundle[:strings.Index(editorBundle, "diff --git a/docs/b.md")] + editorBundle[:strings.Index(editorBundle, "diff --git a/docs/b.md")],
+			wantErr: "more than once",
+		},
+		{
+			name:    "empty patch",
+			patch:   "nothing to see here\n",
+			wantErr: "doesn't change any files",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := createTempDir(t)
+			defer os.RemoveAll(root)
+			writeTestDocs(t, root, tt.docs)
+
+			files, _, err := gitdiff.Parse(strings.NewReader(tt.patch))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the same steps klarity apply takes
+			err = checkPatchPaths(Config{Doc_dirs: []string{"docs"}}, files)
+			if err == nil {
+				_, err = applyPatch(root, "bundle.patch", files, applyOptions{Dry: true})
+			}
+			if err == nil {
+				_, err = applyPatch(root, "bundle.patch", files, applyOptions{})
+			}
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			for rel, want := range tt.want {
+				b, err := os.ReadFile(filepath.Join(root, rel))
+				if want == "" {
+					if err == nil {
+						t.Errorf("%s exists, want it gone", rel)
+					}
+					continue
+				}
+				if string(b) != want {
+					t.Errorf("%s = %q, want %q", rel, b, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPatchSummary(t *testing.T) {
+	files, _, err := gitdiff.Parse(strings.NewReader(editorBundle))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"modified docs/a.md (+1 -1)",
+		"renamed  docs/b.md -> docs/c.md (+0 -0)",
+		"new      docs/new.md (+2 -0)",
+	}
+	if len(files) != len(want) {
+		t.Fatalf("parsed %d files, want %d", len(files), len(want))
+	}
+	for i, f := range files {
+		if got := patchSummary(f); got != want[i] {
+			t.Errorf("summary = %q, want %q", got, want[i])
+		}
+	}
+}
+
+func TestMergeFragments(t *testing.T) {
+	// changes d to D, with two lines of context on each side
+	const patch = "--- a/page.md\n+++ b/page.md\n@@ -2,5 +2,5 @@\n b\n c\n-d\n+D\n e\n f\n"
+
+	tests := []struct {
+		name       string
+		src        string
+		fuzz       int
+		reject     bool
+		want       string
+		wantStatus applyStatus
+	}{
+		{
+			name:       "moved down",
+			src:        "new\nnew\na\nb\nc\nd\ne\nf\ng\n",
+			want:       "new\nnew\na\nb\nc\nD\ne\nf\ng\n",
+			wantStatus: applyFuzzed,
+		},
+		{
+			name:       "context changed",
+			src:        "a\nB\nc\nd\ne\nf\ng\n",
+			fuzz:       1,
+			want:       "a\nB\nc\nD\ne\nf\ng\n",
+			wantStatus: applyFuzzed,
+		},
+		{
+			name:       "context changed without fuzz",
+			src:        "a\nB\nc\nd\ne\nf\ng\n",
+			want:       "a\n" + conflictStart + "B\nc\nd\ne\nf\n" + conflictBase + "b\nc\nd\ne\nf\n" + conflictSep + "b\nc\nD\ne\nf\n" + conflictEnd + "g\n",
+			wantStatus: applyConflicted,
+		},
+		{
+			name:       "changed line changed",
+			src:        "a\nb\nc\nx\ne\nf\ng\n",
+			fuzz:       2,
+			want:       "a\n" + conflictStart + "b\nc\nx\ne\nf\n" + conflictBase + "b\nc\nd\ne\nf\n" + conflictSep + "b\nc\nD\ne\nf\n" + conflictEnd + "g\n",
+			wantStatus: applyConflicted,
+		},
+		{
+			name:       "rejected",
+			src:        "a\nb\nc\nx\ne\nf\ng\n",
+			fuzz:       2,
+			reject:     true,
+			want:       "a\nb\nc\nx\ne\nf\ng\n",
+			wantStatus: applyConflicted,
+		},
+	}
+
+	files, _, err := gitdiff.Parse(strings.NewReader(patch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, status, rejected := mergeFragments([]byte(tt.src), files[0].TextFragments, tt.fuzz, tt.reject)
+			if string(got) != tt.want {
+				t.Errorf("merged =\n%s\nwant\n%s", got, tt.want)
+			}
+			if status != tt.wantStatus {
+				t.Errorf("status = %s, want %s", status, tt.wantStatus)
+			}
+			if wantRejected := status == applyConflicted; (len(rejected) > 0) != wantRejected {
+				t.Errorf("rejected %d hunks, want some: %v", len(rejected), wantRejected)
+			}
+		})
+	}
+}
+
+func TestApplyUndo(t *testing.T) {
+	root := createTempDir(t)
+	defer os.RemoveAll(root)
+	before := map[string]string{"docs/a.md": "# A\ntext\n", "docs/b.md": "# B\n"}
+	writeTestDocs(t, root, before)
+
+	files, _, err := gitdiff.Parse(strings.NewReader(editorBundle))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := applyPatch(root, "bundle.patch", files, applyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "docs/new.md"), []byte("# Edited after\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := loadApplyJournal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes, edited, err := j.undoChanges(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(edited) != 1 || edited[0] != "docs/new.md" {
+		t.Errorf("edited = %v, want [docs/new.md]", edited)
+	}
+	if err := commitChanges(root, j.Patch, changes); err != nil {
+		t.Fatal(err)
+	}
+
+	for rel, want := range before {
+		if b, _ := os.ReadFile(filepath.Join(root, rel)); string(b) != want {
+			t.Errorf("%s = %q, want %q", rel, b, want)
+		}
+	}
+	for _, rel := range []string{"docs/c.md", "docs/new.md"} {
+		if _, err := os.Stat(filepath.Join(root, rel)); err == nil {
+			t.Errorf("%s still exists after undo", rel)
+		}
+	}
+}
+
+func TestApplyUndoRetry(t *testing.T) {
+	root := createTempDir(t)
+	defer os.RemoveAll(root)
+	before := map[string]string{"docs/a.md": "# A\ntext\n", "docs/b.md": "# B\n"}
+	writeTestDocs(t, root, before)
+
+	files, _, err := gitdiff.Parse(strings.NewReader(editorBundle))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := applyPatch(root, "bundle.patch", files, applyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := loadApplyJournal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes, _, err := j.undoChanges(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a directory in place of a page the undo removes can't be backed up
+	if err := os.Remove(filepath.Join(root, "docs/new.md")); err != nil {
+		t.Fatal(err)
+	}
+	writeTestDocs(t, root, map[string]string{"docs/new.md/page.md": "# In the way\n"})
+	if err := commitChanges(root, j.Patch, changes); err == nil {
+		t.Fatal("undo succeeded, want an error")
+	}
+	if b, _ := os.ReadFile(filepath.Join(root, "docs/a.md")); string(b) != "# A edited\ntext\n" {
+		t.Errorf("docs/a.md = %q, want the failed undo to leave it patched", b)
+	}
+
+	// clearing the way and running it again undoes the patch
+	if err := os.RemoveAll(filepath.Join(root, "docs/new.md")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "docs/new.md"), []byte("# New\npage\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	j, err = loadApplyJournal(root)
+	if err != nil {
+		t.Fatalf("journal is gone after a failed undo: %v", err)
+	}
+	changes, _, err = j.undoChanges(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := commitChanges(root, j.Patch, changes); err != nil {
+		t.Fatal(err)
+	}
+	for rel, want := range before {
+		if b, _ := os.ReadFile(filepath.Join(root, rel)); string(b) != want {
+			t.Errorf("%s = %q, want %q", rel, b, want)
+		}
+	}
+	entries, _ := os.ReadDir(filepath.Join(root, cacheDir))
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "apply-") {
+			t.Errorf("temporary journal %s was left behind", e.Name())
+		}
+	}
+}
+
+func TestCommitChangesFailure(t *testing.T) {
+	root := createTempDir(t)
+	defer os.RemoveAll(root)
+	writeTestDocs(t, root, map[string]string{"docs/a.md": "# A\n", "docs/file": "not a dir"})
+
+	changes := []fileChange{
+		{Path: "docs/a.md", Content: []byte("# Changed\n"), Mode: 0644},
+		{Path: "docs/new/page.md", Content: []byte("# New\n"), Mode: 0644},
+		{Path: "docs/file/page.md", Content: []byte("# Can't\n"), Mode: 0644},
+	}
+	if err := commitChanges(root, "bundle.patch", changes); err == nil {
+		t.Fatal("commit succeeded, want an error")
+	}
+
+	if b, _ := os.ReadFile(filepath.Join(root, "docs/a.md")); string(b) != "# A\n" {
+		t.Errorf("docs/a.md = %q, want it unchanged", b)
+	}
+	if _, err := os.Stat(filepath.Join(root, "docs/new")); err == nil {
+		t.Error("docs/new was left behind")
+	}
+	entries, _ := os.ReadDir(filepath.Join(root, "docs"))
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".klarity-") {
+			t.Errorf("staged file %s was left behind", e.Name())
+		}
+	}
+}
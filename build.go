@@ -2,10 +2,15 @@ package main
 
 import (
 	"bytes"
-	"log"
+	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 
 	"slices"
 
@@ -13,17 +18,17 @@ import (
 	enclaveCallout "github.com/quailyquaily/goldmark-enclave/callout"
 	"github.com/yuin/goldmark"
 	highlighting "github.com/yuin/goldmark-highlighting/v2"
+	"github.com/yuin/goldmark/ast"
 	"github.com/yuin/goldmark/extension"
 	"github.com/yuin/goldmark/parser"
 	"github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
 	"go.abhg.dev/goldmark/anchor"
+	"go.abhg.dev/goldmark/frontmatter"
 	"go.abhg.dev/goldmark/wikilink"
 )
 
-var currentlyRendering string
-
-var md goldmark.Markdown
-
 // list of current chroma themes
 var themes = []string{
 	"abap",
@@ -99,18 +104,13 @@ func isValidTheme(name string) bool {
 	return slices.Contains(themes, name)
 }
 
-func InitMarkdown(path string) {
-	path, err := filepath.Abs(path)
-	if err != nil {
-		log.Fatal(err)
-	}
-	c := ReadConfig(path)
+func newMarkdown(c Config) goldmark.Markdown {
 	theme := "rose-pine-moon" // default
 	if c.Visual.Theme != "" && isValidTheme(c.Visual.Theme) {
 		theme = c.Visual.Theme
 	}
 
-	md = goldmark.New(
+	return goldmark.New(
 		goldmark.WithExtensions(
 			extension.GFM,
 			extension.Linkify,
@@ -119,14 +119,19 @@ func InitMarkdown(path string) {
 				highlighting.WithStyle(theme),
 			),
 			mathjax.MathJax,
-			&wikilink.Extender{
-				Resolver: KlarityResolver{},
-			},
+			wikilinkExtender{},
 			enclaveCallout.New(),
 			&anchor.Extender{},
+			&frontmatter.Extender{},
 		),
 		goldmark.WithParserOptions(
 			parser.WithAutoHeadingID(),
+			parser.WithASTTransformers(
+				util.Prioritized(pageContextTransformer{}, 0),
+				util.Prioritized(linkTransformer{}, 0),
+				util.Prioritized(tocTransformer{}, 0),
+				util.Prioritized(searchTransformer{}, 0),
+			),
 		),
 		goldmark.WithRendererOptions(
 			html.WithHardWraps(),
@@ -135,50 +140,130 @@ func InitMarkdown(path string) {
 	)
 }
 
-type KlarityResolver struct{}
+// pageContext describes the page being rendered, it travels with the goldmark parser.Context
+// so any number of pages (or whole builds) can be rendered at the same time
+type pageContext struct {
+	root   string // absolute project root
+	source string // absolute path of the markdown file
+	cfg    Config
 
-// finally fixed the resolver, but still needs [[!]] resolution xd
-func (KlarityResolver) ResolveWikilink(n *wikilink.Node) (destination []byte, err error) {
-	if currentlyRendering == "" {
-		return nil, nil
-	}
-	base := normalizeURL(ReadConfig(pwd).Base_URL)
+	assets  map[string]bool // files the page links to or embeds, copied into the output
+	deps    map[string]bool // embedded pages and missing files the page depends on
+	parents []string        // pages this one is being embedded into
+	toc     []*TOCEntry
+	search  []searchSection
+}
 
-	entryAbs := filepath.Clean(filepath.Join(pwd, config.Entry))
-	// log.Print("entry: ", entryAbs)
+func newPageContext(root, source string, c Config) *pageContext {
+	return &pageContext{
+		root:   root,
+		source: source,
+		cfg:    c,
+		assets: make(map[string]bool),
+		deps:   make(map[string]bool),
+	}
+}
 
-	targetRaw := string(n.Target)
-	ext := filepath.Ext(targetRaw)
+// assetURL returns the URL a file referenced by the page will have in the output and marks it to be copied there,
+// only files in doc_dirs and static_dirs are published, files that don't exist are published once they do
+func (p *pageContext) assetURL(path string) (string, bool) {
+	rel, err := filepath.Rel(p.root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	if !isStaticFile(p.cfg, p.root, path) {
+		page, _ := filepath.Rel(p.root, p.source)
+		slog.Warn("link to a file outside doc_dirs and static_dirs, it is not published", "page", filepath.ToSlash(page), "file", filepath.ToSlash(rel))
+		return "", false
+	}
+	if info, err := os.Stat(path); err != nil || info.IsDir() {
+		// re-render the page once the file shows up
+		p.deps[path] = true
+		return "", false
+	}
+	p.assets[path] = true
+	return normalizeURL(p.cfg.Base_URL) + "/" + filepath.ToSlash(rel), true
+}
 
-	// log.Printf("raw: %s, ext: %s", targetRaw, ext)
+// pageURL returns the URL of the built page for a markdown file, the entry becomes index.html
+func (p *pageContext) pageURL(path string) (string, bool) {
+	rel, err := filepath.Rel(p.root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	base := normalizeURL(p.cfg.Base_URL)
+	if path == filepath.Clean(filepath.Join(p.root, p.cfg.Entry)) {
+		return base + "/index.html", true
+	}
+	return base + "/" + filepath.ToSlash(pageOutPath(p.root, p.cfg, path)), true
+}
 
-	var candidateMD string
-	baseDir := filepath.Dir(currentlyRendering)
-	switch ext {
-	case "":
-		candidateMD = filepath.Join(baseDir, targetRaw+".md")
-	case ".md":
-		candidateMD = filepath.Join(baseDir, targetRaw)
-	default:
-		return nil, nil // not .md link | handle like default resolver
+// pageOutPath is where the page built from the markdown file doc goes, relative to output_dir
+func pageOutPath(root string, c Config, doc string) string {
+	rel, _ := filepath.Rel(root, doc)
+	if c.pagesFromDocDirs {
+		for _, dir := range c.Doc_dirs {
+			if r, err := filepath.Rel(filepath.Join(root, dir), doc); err == nil && filepath.IsLocal(r) {
+				rel = r
+				break
+			}
+		}
 	}
-	candidateMD = filepath.Clean(candidateMD)
+	return strings.TrimSuffix(rel, filepath.Ext(rel)) + ".html"
+}
 
-	// log.Print("candidate: ", candidateMD)
+var pageContextKey = parser.NewContextKey()
 
-	relCand, err := filepath.Rel(pwd, candidateMD)
-	if err != nil {
-		return nil, err
+var pageContextAttr = []byte("klarity-page")
+
+// pageContextTransformer hands the pageContext from the parser.Context over to the nodes
+// that need it at render time, since renderers and resolvers only ever see the node
+type pageContextTransformer struct{}
+
+func (pageContextTransformer) Transform(doc *ast.Document, _ text.Reader, pc parser.Context) {
+	page, ok := pc.Get(pageContextKey).(*pageContext)
+	if !ok {
+		return
+	}
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if entering && n.Kind() == wikilink.Kind {
+			n.SetAttribute(pageContextAttr, page)
+		}
+		return ast.WalkContinue, nil
+	})
+}
+
+func nodePageContext(n ast.Node) *pageContext {
+	v, ok := n.Attribute(pageContextAttr)
+	if !ok {
+		return nil
 	}
-	relCand = filepath.ToSlash(relCand)
+	page, _ := v.(*pageContext)
+	return page
+}
 
-	// log.Print("relCandidate: ", relCand)
+type KlarityResolver struct{}
 
-	var dest string
-	if candidateMD == entryAbs {
-		dest = base + "/index.html"
-	} else {
-		dest = base + "/" + strings.TrimSuffix(relCand, ".md") + ".html"
+// resolves [[page]] links to the built page and [[file.pdf]] links to the published file,
+// ![[...]] embeds are rendered by embedRenderer
+func (KlarityResolver) ResolveWikilink(n *wikilink.Node) (destination []byte, err error) {
+	page := nodePageContext(n)
+	if page == nil {
+		return nil, nil
+	}
+	candidateMD := wikilinkTarget(page.source, string(n.Target))
+	if candidateMD == "" {
+		// not .md link, link straight to the file if it can be published
+		dest, ok := page.assetURL(filepath.Join(filepath.Dir(page.source), string(n.Target)))
+		if !ok {
+			return nil, nil
+		}
+		return []byte(dest), nil
+	}
+
+	dest, ok := page.pageURL(candidateMD)
+	if !ok {
+		return nil, nil
 	}
 
 	if len(n.Fragment) > 0 {
@@ -189,6 +274,24 @@ func (KlarityResolver) ResolveWikilink(n *wikilink.Node) (destination []byte, er
 	return []byte(dest), nil
 }
 
+// wikilinkTarget returns the markdown file a wikilink target points to when written in source,
+// or "" if the target is not a page
+func wikilinkTarget(source, target string) string {
+	if target == "" {
+		return source // [[#heading]] links to the same page
+	}
+
+	baseDir := filepath.Dir(source)
+	switch filepath.Ext(target) {
+	case "":
+		return filepath.Clean(filepath.Join(baseDir, target+".md"))
+	case ".md":
+		return filepath.Clean(filepath.Join(baseDir, target))
+	default:
+		return ""
+	}
+}
+
 func normalizeURL(url string) string {
 	if url == "/" {
 		return ""
@@ -204,7 +307,8 @@ func collectMarkdownFiles(config Config, root string) ([]string, error) {
 			if err != nil {
 				return err
 			}
-			if !info.IsDir() && filepath.Ext(path) == ".md" {
+			// _index.md only configures the sidebar, see loadNavManifest
+			if !info.IsDir() && filepath.Ext(path) == ".md" && info.Name() != "_index.md" {
 				files = append(files, path)
 			}
 			return nil
@@ -216,8 +320,135 @@ func collectMarkdownFiles(config Config, root string) ([]string, error) {
 	return files, nil
 }
 
-func renderMarkdown(src []byte) (string, error) {
+func renderMarkdown(md goldmark.Markdown, page *pageContext, src []byte) (string, FrontMatter, error) {
 	var buf bytes.Buffer
-	err := md.Convert(src, &buf)
-	return buf.String(), err
+	ctx := parser.NewContext()
+	ctx.Set(pageContextKey, page)
+	if err := md.Convert(src, &buf, parser.WithContext(ctx)); err != nil {
+		return "", FrontMatter{}, err
+	}
+	fm, err := readFrontMatter(ctx)
+	return buf.String(), fm, err
+}
+
+// buildError is a build failure in a file of the project, the dev server shows where it happened
+type buildError struct {
+	File string // relative to the project root, with forward slashes
+	Line int    // 0 if it isn't known
+	Err  error
+}
+
+func (e *buildError) Error() string { return e.Err.Error() }
+func (e *buildError) Unwrap() error { return e.Err }
+
+// front matter parsers count lines from the first line after the opening delimiter
+var frontMatterLineRe = regexp.MustCompile(`(?:yaml|toml): line (\d+)`)
+
+type renderResult struct {
+	html   string
+	fm     FrontMatter
+	sum    string            // hash of the markdown source
+	assets []string          // files to copy into the output, relative to the project root
+	deps   map[string]string // hashes of embedded pages and missing files, relative to the project root
+	toc    []*TOCEntry       // headings for the "On this page" panel
+	search []searchSection   // text of the page for the built-in search index
+	fresh  bool              // false if the page was taken from the build cache
+	err    error
+}
+
+// renderPages renders docs on a pool of workers, pages with an unchanged source are taken from prev,
+// results are in the same order as docs
+func renderPages(md goldmark.Markdown, root string, c Config, docs []string, prev *buildCache, workers int) []renderResult {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	workers = min(workers, len(docs))
+
+	results := make([]renderResult, len(docs))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = renderPage(md, root, c, docs[i], prev)
+			}
+		}()
+	}
+	for i := range docs {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results
+}
+
+func renderPage(md goldmark.Markdown, root string, c Config, doc string, prev *buildCache) renderResult {
+	b, err := os.ReadFile(doc)
+	if err != nil {
+		return renderResult{err: err}
+	}
+	relPath, err := filepath.Rel(root, doc)
+	if err != nil {
+		return renderResult{err: fmt.Errorf("unable to determine relative path for '%s': %w", doc, err)}
+	}
+
+	sum := hashBytes(b)
+	if cached, ok := prev.Pages[relPath]; ok && cached.Source == sum && depsUnchanged(root, cached.Deps) && assetsExist(root, cached.Assets) {
+		return renderResult{html: cached.HTML, fm: cached.Meta, sum: sum, assets: cached.Assets, deps: cached.Deps, toc: cached.TOC, search: cached.Search}
+	}
+
+	page := newPageContext(root, doc, c)
+	html, fm, err := renderMarkdown(md, page, b)
+	if err != nil {
+		line := 0
+		if m := frontMatterLineRe.FindStringSubmatch(err.Error()); m != nil {
+			line, _ = strconv.Atoi(m[1])
+			line++
+		}
+		return renderResult{err: &buildError{File: filepath.ToSlash(relPath), Line: line, Err: fmt.Errorf("failed to render '%s': %w", doc, err)}}
+	}
+
+	res := renderResult{html: html, fm: fm, sum: sum, deps: make(map[string]string), toc: page.toc, search: page.search, fresh: true}
+	for asset := range page.assets {
+		res.assets = append(res.assets, relOrAbs(root, asset))
+	}
+	slices.Sort(res.assets)
+	for dep := range page.deps {
+		sum := "" // missing
+		if b, err := os.ReadFile(dep); err == nil {
+			sum = hashBytes(b)
+		}
+		res.deps[relOrAbs(root, dep)] = sum
+	}
+	return res
+}
+
+func assetsExist(root string, assets []string) bool {
+	for _, rel := range assets {
+		if _, err := os.Stat(filepath.Join(root, filepath.FromSlash(rel))); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// depsUnchanged reports if every file a cached page depends on still has the same content,
+// or is still missing
+func depsUnchanged(root string, deps map[string]string) bool {
+	for rel, sum := range deps {
+		b, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(rel)))
+		if err != nil {
+			if sum != "" {
+				return false
+			}
+			continue
+		}
+		if hashBytes(b) != sum {
+			return false
+		}
+	}
+	return true
 }
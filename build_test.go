@@ -0,0 +1,450 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestDocs(t *testing.T, root string, docs map[string]string) []string {
+	var paths []string
+	for rel, content := range docs {
+		p := filepath.Join(root, rel)
+		if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+			t.Fatalf("failed to create doc dir: %v", err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write doc: %v", err)
+		}
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+func TestRenderPagesResolvesWikilinksPerPage(t *testing.T) {
+	tests := []struct {
+		name    string
+		workers int
+	}{
+		{name: "sequential", workers: 1},
+		{name: "parallel", workers: 8},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := createTempDir(t)
+			defer os.RemoveAll(root)
+
+			docs := map[string]string{}
+			want := map[string]string{}
+			for i := range 32 {
+				rel := fmt.Sprintf("docs/dir%d/page.md", i)
+				docs[rel] = "# Page\n\nSee [[other#part]]\n"
+				want[filepath.Join(root, rel)] = fmt.Sprintf(`href="/docs/dir%d/other.html#part"`, i)
+			}
+			docs["docs/main.md"] = "See [[dir0/page]]\n"
+			want[filepath.Join(root, "docs/main.md")] = `href="/docs/dir0/page.html"`
+
+			c := Config{Base_URL: "/", Doc_dirs: []string{"docs"}, Entry: "docs/index.md"}
+			paths := writeTestDocs(t, root, docs)
+
+			results := renderPages(newMarkdown(c), root, c, paths, newBuildCache("", ""), tt.workers)
+			for i, p := range paths {
+				if results[i].err != nil {
+					t.Fatalf("renderPages() failed for %s: %v", p, results[i].err)
+				}
+				if !strings.Contains(results[i].html, want[p]) {
+					t.Errorf("renderPages() for %s = %q, want it to contain %s", p, results[i].html, want[p])
+				}
+			}
+		})
+	}
+}
+
+func TestRenderPagesFrontMatter(t *testing.T) {
+	root := createTempDir(t)
+	defer os.RemoveAll(root)
+
+	paths := writeTestDocs(t, root, map[string]string{
+		"docs/yaml.md": "---\ntitle: Getting Started\nweight: 2\ndraft: true\ntags: [a, b]\n---\n# Body\n",
+		"docs/toml.md": "+++\ntitle = \"Toml Page\"\ndescription = \"desc\"\n+++\n# Body\n",
+	})
+
+	c := Config{Base_URL: "/", Doc_dirs: []string{"docs"}}
+	results := renderPages(newMarkdown(c), root, c, paths, newBuildCache("", ""), 0)
+	for i, p := range paths {
+		res := results[i]
+		if res.err != nil {
+			t.Fatalf("renderPages() failed for %s: %v", p, res.err)
+		}
+		if strings.Contains(res.html, "title") {
+			t.Errorf("front matter leaked into the rendered page %s: %q", p, res.html)
+		}
+		switch filepath.Base(p) {
+		case "yaml.md":
+			if res.fm.Title != "Getting Started" || res.fm.Weight != 2 || !res.fm.Draft || len(res.fm.Tags) != 2 {
+				t.Errorf("unexpected yaml front matter: %+v", res.fm)
+			}
+		case "toml.md":
+			if res.fm.Title != "Toml Page" || res.fm.Description != "desc" {
+				t.Errorf("unexpected toml front matter: %+v", res.fm)
+			}
+		}
+	}
+}
+
+func TestRenderPagesEmbeds(t *testing.T) {
+	root := createTempDir(t)
+	defer os.RemoveAll(root)
+
+	paths := writeTestDocs(t, root, map[string]string{
+		"docs/main.md":      "![[img/logo.png|64]]\n\n![[files/spec.pdf]]\n\n![[other#Usage]]\n\n![[main]]\n",
+		"docs/other.md":     "# Other\n\n## Usage\n\nused here\n\n## Later\n\nnot embedded\n",
+		"docs/img/logo.png": "png",
+	})
+	for _, p := range paths {
+		if filepath.Base(p) != "main.md" {
+			continue
+		}
+		c := Config{Base_URL: "/", Doc_dirs: []string{"docs"}}
+		res := renderPage(newMarkdown(c), root, c, p, newBuildCache("", ""))
+		if res.err != nil {
+			t.Fatalf("renderPage() failed: %v", res.err)
+		}
+
+		for _, want := range []string{
+			`<img src="/docs/img/logo.png" alt="" width="64">`,
+			"![[files/spec.pdf]]",
+			`<div class="transclusion" data-source="docs/other.md">`,
+			"used here",
+			"can't be embedded inside itself",
+		} {
+			if !strings.Contains(res.html, want) {
+				t.Errorf("renderPage() = %q, want it to contain %q", res.html, want)
+			}
+		}
+		if strings.Contains(res.html, "not embedded") {
+			t.Errorf("renderPage() embedded more than the requested section: %q", res.html)
+		}
+		if len(res.assets) != 1 || res.assets[0] != "docs/img/logo.png" {
+			t.Errorf("renderPage() assets = %v, want [docs/img/logo.png]", res.assets)
+		}
+		if _, ok := res.deps["docs/other.md"]; !ok {
+			t.Errorf("renderPage() deps = %v, want docs/other.md", res.deps)
+		}
+	}
+}
+
+func TestRenderPagesRewritesMarkdownLinks(t *testing.T) {
+	root := createTempDir(t)
+	defer os.RemoveAll(root)
+
+	paths := writeTestDocs(t, root, map[string]string{
+		"docs/guide/setup.md": "[config](../Config.md#dev) [home](../main.md) [self](setup.md#top) [here](#top) [out](https://example.com/a.md)\n",
+	})
+
+	c := Config{Base_URL: "/site", Doc_dirs: []string{"docs"}, Entry: "docs/main.md"}
+	res := renderPage(newMarkdown(c), root, c, paths[0], newBuildCache("", ""))
+	if res.err != nil {
+		t.Fatalf("renderPage() failed: %v", res.err)
+	}
+
+	for _, want := range []string{
+		`href="/site/docs/Config.html#dev"`,
+		`href="/site/index.html"`,
+		`href="/site/docs/guide/setup.html#top"`,
+		`href="#top"`,
+		`href="https://example.com/a.md"`,
+	} {
+		if !strings.Contains(res.html, want) {
+			t.Errorf("renderPage() = %q, want it to contain %s", res.html, want)
+		}
+	}
+}
+
+func TestBuildSiteDoesNotPublishProjectFiles(t *testing.T) {
+	root := createTempDir(t)
+	defer os.RemoveAll(root)
+
+	writeTestDocs(t, root, map[string]string{
+		"docs/main.md":      "[config](../klarity.toml) [env](../.env) [[../notes.txt]] ![logo](img/logo.png)",
+		"docs/img/logo.png": "png",
+		"klarity.toml":      "title = \"secret\"",
+		".env":              "TOKEN=secret",
+		"notes.txt":         "notes",
+	})
+	c := Config{Title: "Test", Output_dir: "out", Base_URL: "/", Doc_dirs: []string{"docs"}, Entry: "docs/main.md"}
+	c.Build.Search = "none"
+	if err := buildSite(site{root: root, src: root, cfg: c}, buildOptions{}); err != nil {
+		t.Fatalf("buildSite() error = %v", err)
+	}
+
+	for _, rel := range []string{"klarity.toml", ".env", "notes.txt"} {
+		if _, err := os.Stat(filepath.Join(root, "out", rel)); err == nil {
+			t.Errorf("%s was published", rel)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "out", "docs", "img", "logo.png")); err != nil {
+		t.Errorf("docs/img/logo.png was not published: %v", err)
+	}
+	index, _ := os.ReadFile(filepath.Join(root, "out", "index.html"))
+	if !strings.Contains(string(index), `href="../klarity.toml"`) {
+		t.Errorf("link to klarity.toml was rewritten, want it left alone")
+	}
+}
+
+func TestRenderPagesTOC(t *testing.T) {
+	tests := []struct {
+		name  string
+		depth int
+		want  string
+	}{
+		{name: "default depth", depth: 0, want: "setup(install) usage api"},
+		{name: "deep", depth: 4, want: "setup(install(linux)) usage api"},
+		{name: "shallow", depth: 2, want: "setup usage api"},
+		{name: "disabled", depth: -1, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := createTempDir(t)
+			defer os.RemoveAll(root)
+
+			paths := writeTestDocs(t, root, map[string]string{
+				"docs/page.md": "# Title\n\n## Setup\n\n### Install\n\n#### Linux\n\n## Usage\n\n> ## Not a section\n\n## API\n",
+			})
+
+			c := Config{Base_URL: "/", Doc_dirs: []string{"docs"}}
+			c.Visual.TOCDepth = tt.depth
+			res := renderPage(newMarkdown(c), root, c, paths[0], newBuildCache("", ""))
+			if res.err != nil {
+				t.Fatalf("renderPage() failed: %v", res.err)
+			}
+			if got := tocString(res.toc); got != tt.want {
+				t.Errorf("renderPage() toc = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func tocString(toc []*TOCEntry) string {
+	var parts []string
+	for _, e := range toc {
+		s := e.ID
+		if len(e.Children) > 0 {
+			s += "(" + tocString(e.Children) + ")"
+		}
+		parts = append(parts, s)
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestBuildSiteChanges(t *testing.T) {
+	root := createTempDir(t)
+	defer os.RemoveAll(root)
+
+	writeTestDocs(t, root, map[string]string{
+		"docs/main.md":  "# Home",
+		"docs/guide.md": "# Guide",
+		"custom.css":    "body {}",
+	})
+	c := Config{Title: "Test", Output_dir: "out", Base_URL: "/", Doc_dirs: []string{"docs"}, Entry: "docs/main.md"}
+	c.Build.Search = "none"
+	c.Visual.CustomCSS = filepath.Join(root, "custom.css")
+
+	build := func() buildChanges {
+		t.Helper()
+		var got buildChanges
+		opts := buildOptions{OnBuilt: func(c buildChanges) { got = c }}
+		if err := buildSite(site{root: root, src: root, cfg: c}, opts); err != nil {
+			t.Fatalf("buildSite() error = %v", err)
+		}
+		return got
+	}
+
+	if got := build(); !got.Reload {
+		t.Errorf("first build = %+v, want a reload", got)
+	}
+
+	writeTestDocs(t, root, map[string]string{"docs/guide.md": "# Guide\n\nmore"})
+	got := build()
+	if got.Reload || got.Nav || len(got.CSS) > 0 || fmt.Sprint(got.Pages) != "[/docs/guide.html]" {
+		t.Errorf("after editing a page = %+v, want only /docs/guide.html", got)
+	}
+
+	writeTestDocs(t, root, map[string]string{"custom.css": "body { color: red }"})
+	got = build()
+	if got.Reload || len(got.Pages) > 0 || fmt.Sprint(got.CSS) != "[/custom.css]" {
+		t.Errorf("after editing custom_css = %+v, want only /custom.css", got)
+	}
+
+	c.Visual.Vars.AccentPrimary = "#fff"
+	got = build()
+	if got.Reload || len(got.Pages) > 0 || fmt.Sprint(got.CSS) != "[/vars.css]" {
+		t.Errorf("after changing vars = %+v, want only /vars.css", got)
+	}
+
+	writeTestDocs(t, root, map[string]string{"docs/new.md": "# New"})
+	if got := build(); !got.Nav || len(got.Pages) != 3 {
+		t.Errorf("after adding a page = %+v, want the nav and every page", got)
+	}
+}
+
+func TestBuildErrorLocation(t *testing.T) {
+	const cfg = "title = \"Test\"\noutput_dir = \"out\"\ndoc_dirs = [\"docs\"]\nentry = \"docs/main.md\"\ntemplates_dir = \"tpl\"\n\n[build]\nsearch = \"none\"\n"
+
+	tests := []struct {
+		name     string
+		files    map[string]string
+		wantFile string
+		wantLine int
+	}{
+		{
+			name:     "config",
+			files:    map[string]string{"klarity.toml": "title = \"Test\"\n\noutput_dir = \n", "docs/main.md": "# Home"},
+			wantFile: "klarity.toml",
+			wantLine: 3,
+		},
+		{
+			name:     "front matter",
+			files:    map[string]string{"klarity.toml": cfg, "docs/main.md": "+++\ntitle = \n+++\n# Home"},
+			wantFile: "docs/main.md",
+			wantLine: 2,
+		},
+		{
+			name:     "template syntax",
+			files:    map[string]string{"klarity.toml": cfg, "docs/main.md": "# Home", "tpl/footer.html": "<footer>\n{{ .Title </footer>"},
+			wantFile: "tpl/footer.html",
+			wantLine: 2,
+		},
+		{
+			name:     "template execution",
+			files:    map[string]string{"klarity.toml": cfg, "docs/main.md": "# Home", "tpl/footer.html": "\n\n{{ .Missing }}"},
+			wantFile: "tpl/footer.html",
+			wantLine: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := createTempDir(t)
+			defer os.RemoveAll(root)
+			writeTestDocs(t, root, tt.files)
+
+			err := buildKlarity(root, buildOptions{})
+			var berr *buildError
+			if !errors.As(err, &berr) {
+				t.Fatalf("buildKlarity() error = %v, want a buildError", err)
+			}
+			if berr.File != tt.wantFile || berr.Line != tt.wantLine {
+				t.Errorf("buildKlarity() error at %s:%d, want %s:%d", berr.File, berr.Line, tt.wantFile, tt.wantLine)
+			}
+		})
+	}
+}
+
+func TestBuildSiteSearchFallback(t *testing.T) {
+	root := createTempDir(t)
+	defer os.RemoveAll(root)
+	// neither pagefind nor npx can be found, so the built-in index is used
+	t.Setenv("PATH", "")
+
+	writeTestDocs(t, root, map[string]string{"docs/main.md": "# Home"})
+	c := Config{Title: "Test", Output_dir: "out", Base_URL: "/", Doc_dirs: []string{"docs"}, Entry: "docs/main.md"}
+	build := func() {
+		t.Helper()
+		if err := buildSite(site{root: root, src: root, cfg: c}, buildOptions{}); err != nil {
+			t.Fatalf("buildSite() error = %v", err)
+		}
+	}
+
+	build()
+	// a new index starts from an empty directory, so this only survives if it isn't generated again
+	marker := filepath.Join(root, "out", searchIndexDir, "marker")
+	if err := os.WriteFile(marker, nil, 0644); err != nil {
+		t.Fatalf("built-in index wasn't written: %v", err)
+	}
+	build()
+	if _, err := os.Stat(marker); err != nil {
+		t.Error("the search index was generated again without any page changing")
+	}
+}
+
+func TestBuildCache(t *testing.T) {
+	root := createTempDir(t)
+	defer os.RemoveAll(root)
+	// no pagefind, the search index isn't part of what is tested here
+	t.Setenv("PATH", "")
+
+	const cfg = "output_dir = \"public\"\nbase_url = \"/\"\ndoc_dirs = [\"docs\"]\nentry = \"docs/main.md\"\n"
+	writeTestDocs(t, root, map[string]string{
+		"klarity.toml":  "title = \"Test\"\n" + cfg,
+		"docs/main.md":  "# Home",
+		"docs/guide.md": "# Guide",
+	})
+
+	build := func() {
+		t.Helper()
+		if err := buildKlarity(root, buildOptions{}); err != nil {
+			t.Fatalf("buildKlarity() error = %v", err)
+		}
+	}
+	// swaps the cached HTML of the guide for a marker, which ends up in the output
+	// only if the next build reuses the cache instead of rendering the page
+	markCache := func() {
+		t.Helper()
+		c := ReadConfig(root)
+		prev, ok := loadBuildCache(root, "", configHash(c), templatesHash(root, c))
+		if !ok {
+			t.Fatal("the build cache can't be reused")
+		}
+		prev.Pages["docs/guide.md"].HTML = "<p>from the cache</p>"
+		if err := prev.save(root, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fromCache := func() bool {
+		b, err := os.ReadFile(filepath.Join(root, "public", "docs", "guide.html"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Contains(string(b), "from the cache")
+	}
+
+	build()
+	markCache()
+	build()
+	if !fromCache() {
+		t.Error("unchanged page was rendered again")
+	}
+
+	tests := []struct {
+		name   string
+		change func()
+	}{
+		{name: "source", change: func() { writeTestDocs(t, root, map[string]string{"docs/guide.md": "# Guide\n\nmore"}) }},
+		{name: "config", change: func() { writeTestDocs(t, root, map[string]string{"klarity.toml": "title = \"Other\"\n" + cfg}) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			markCache()
+			tt.change()
+			build()
+			if fromCache() {
+				t.Errorf("page wasn't rendered again after a %s change", tt.name)
+			}
+		})
+	}
+
+	// the embedded templates can't change while testing, a cache built with others is dropped
+	c := ReadConfig(root)
+	if _, ok := loadBuildCache(root, "", configHash(c), "other templates"); ok {
+		t.Error("cache built with other templates was reused")
+	}
+	if _, ok := loadBuildCache(root, "", configHash(c), templatesHash(root, c)); !ok {
+		t.Error("cache built with the same templates was dropped")
+	}
+}
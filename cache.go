@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/BurntSushi/toml"
+)
+
+const cacheDir = ".klarity"
+
+// buildCache remembers what the last build rendered so unchanged pages can be skipped,
+// it is only reused if the config and templates it was built with did not change
+type buildCache struct {
+	Version   string                 `json:"version"`
+	Config    string                 `json:"config"`
+	Templates string                 `json:"templates"`
+	Pages     map[string]*cachedPage `json:"pages"`  // keyed by source path relative to the project root
+	Static    []string               `json:"static"` // files copied from doc_dirs and static_dirs
+	Nav       string                 `json:"nav"`    // hash of the sidebar, to tell the dev server when it changed
+}
+
+type cachedPage struct {
+	Source  string            `json:"source"`   // hash of the markdown source
+	HTML    string            `json:"html"`     // rendered markdown, before templating
+	Meta    FrontMatter       `json:"meta"`     // parsed front matter
+	Assets  []string          `json:"assets"`   // files the page references, copied into the output
+	Deps    map[string]string `json:"deps"`     // hashes of embedded pages, empty for files that were missing
+	TOC     []*TOCEntry       `json:"toc"`      // headings for the "On this page" panel
+	Search  []searchSection   `json:"search"`   // text of the page for the built-in search index
+	Output  string            `json:"output"`   // hash of the templated page
+	OutPath string            `json:"out_path"` // written page relative to output_dir, empty for drafts
+}
+
+func newBuildCache(cfgHash, tplHash string) *buildCache {
+	return &buildCache{
+		Version:   appVersion,
+		Config:    cfgHash,
+		Templates: tplHash,
+		Pages:     make(map[string]*cachedPage),
+	}
+}
+
+// buildCachePath is where the cache of a site is kept, name is empty for the main site
+// and the label of the version for multi-version builds, the dev server prefixes it with dev
+func buildCachePath(root, name string) string {
+	if name == "" {
+		return filepath.Join(root, cacheDir, "cache", "build.json")
+	}
+	return filepath.Join(root, cacheDir, "cache", "build-"+name+".json")
+}
+
+// loadBuildCache returns the previous build cache and true if it can be reused,
+// otherwise an empty cache and false
+func loadBuildCache(root, name, cfgHash, tplHash string) (*buildCache, bool) {
+	b, err := os.ReadFile(buildCachePath(root, name))
+	if err != nil {
+		return newBuildCache(cfgHash, tplHash), false
+	}
+
+	var c buildCache
+	if err := json.Unmarshal(b, &c); err != nil || c.Pages == nil {
+		return newBuildCache(cfgHash, tplHash), false
+	}
+
+	if c.Version != appVersion || c.Config != cfgHash || c.Templates != tplHash {
+		return newBuildCache(cfgHash, tplHash), false
+	}
+
+	return &c, true
+}
+
+func (c *buildCache) save(root, name string) error {
+	path := buildCachePath(root, name)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	if err := writeCacheIgnore(root); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// writeCacheIgnore keeps .klarity out of version control the same way ignore_out does for the output
+func writeCacheIgnore(root string) error {
+	ignore := filepath.Join(root, cacheDir, ".gitignore")
+	if _, err := os.Stat(ignore); os.IsNotExist(err) {
+		return os.WriteFile(ignore, []byte("*\n"), 0644)
+	}
+	return nil
+}
+
+func clearBuildCache(root string) error {
+	if err := os.RemoveAll(filepath.Join(root, cacheDir, "cache")); err != nil {
+		return fmt.Errorf("failed to remove build cache: %w", err)
+	}
+	return nil
+}
+
+func hashBytes(parts ...[]byte) string {
+	h := sha256.New()
+	for _, p := range parts {
+		// length prefix so ("ab", "c") and ("a", "bc") don't collide
+		fmt.Fprintf(h, "%d:", len(p))
+		h.Write(p)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func configHash(c Config) string {
+	// vars only end up in vars.css, which is written on every build,
+	// the worker count and the dev server settings don't change what is built
+	c.Visual.Vars = VarsConfig{}
+	c.Dev = DevConfig{}
+	c.Build.Workers = 0
+	b, err := toml.Marshal(c)
+	if err != nil {
+		return ""
+	}
+	return hashBytes(b)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"os"
 	"path/filepath"
@@ -9,21 +10,33 @@ import (
 )
 
 type Config struct {
-	Title      string       `toml:"title"`
-	Output_dir string       `toml:"output_dir"`
-	Base_URL   string       `toml:"base_url"`
-	Doc_dirs   []string     `toml:"doc_dirs"`
-	Entry      string       `toml:"entry"`
-	Ignore_out bool         `toml:"ignore_out"`
-	Visual     VisualConfig `toml:"visual"`
-	Dev        DevConfig    `toml:"dev"`
-	Editor     EditorConfig `toml:"editor"`
+	Title         string         `toml:"title"`
+	Output_dir    string         `toml:"output_dir"`
+	Base_URL      string         `toml:"base_url"`
+	Doc_dirs      []string       `toml:"doc_dirs"`
+	Static_dirs   []string       `toml:"static_dirs,omitempty"`
+	Templates_dir string         `toml:"templates_dir,omitempty"`
+	Entry         string         `toml:"entry"`
+	Ignore_out    bool           `toml:"ignore_out"`
+	Visual        VisualConfig   `toml:"visual"`
+	Dev           DevConfig      `toml:"dev"`
+	Editor        EditorConfig   `toml:"editor"`
+	Build         BuildConfig    `toml:"build,omitempty"`
+	Nav           NavConfig      `toml:"nav,omitempty"`
+	Versions      VersionsConfig `toml:"versions,omitempty"`
+	Locales       []LocaleConfig `toml:"locales,omitempty"`
+
+	// pages are placed relative to the doc dir they are in instead of the project root,
+	// set for locales, which are built into output_dir/<lang> already
+	pagesFromDocDirs bool
 }
 
 type VisualConfig struct {
 	Theme     string     `toml:"theme"`
 	SPA       bool       `toml:"use_spa"`
 	CustomCSS string     `toml:"custom_css"`
+	Style     string     `toml:"style,omitempty"`    // replaces the built-in stylesheet, usually ejected with klarity eject
+	TOCDepth  int        `toml:"toc_depth,omitzero"` // deepest heading level in the "On this page" panel, 0 is the default, -1 turns it off
 	Vars      VarsConfig `toml:"vars"`
 }
 
@@ -41,7 +54,61 @@ type VarsConfig struct {
 }
 
 type DevConfig struct {
-	Port int `toml:"port"`
+	Port    int    `toml:"port"`
+	Host    string `toml:"host,omitempty"`     // address to listen on, 0.0.0.0 makes the server reachable from other devices
+	TLS     bool   `toml:"tls,omitempty"`      // serve over https, with a self-signed certificate unless tls_cert and tls_key are set
+	TLSCert string `toml:"tls_cert,omitempty"` // relative to klarity.toml
+	TLSKey  string `toml:"tls_key,omitempty"`
+}
+
+type BuildConfig struct {
+	Workers int    `toml:"workers,omitzero"` // pages rendered in parallel, 0 uses every CPU
+	Search  string `toml:"search,omitempty"` // search engine, pagefind (default), builtin or none
+}
+
+// NavConfig is the manifest of the top of the sidebar,
+// other folders can be configured in folders keyed by their path relative to the doc dir
+type NavConfig struct {
+	NavManifest
+	Folders map[string]NavManifest `toml:"folders,omitempty"`
+}
+
+// NavManifest changes how a single folder is listed in the sidebar, it can also be
+// a _nav.toml file or the front matter of an _index.md file in the folder itself
+type NavManifest struct {
+	Title  string            `toml:"title,omitempty" yaml:"title"`   // label of the folder itself
+	Order  []string          `toml:"order,omitempty" yaml:"order"`   // file, folder or link names listed first, in this order
+	Hide   []string          `toml:"hide,omitempty" yaml:"hide"`     // file or folder names left out of the sidebar
+	Labels map[string]string `toml:"labels,omitempty" yaml:"labels"` // display names by file or folder name
+	Links  []NavLink         `toml:"links,omitempty" yaml:"links"`   // external links listed with the pages
+}
+
+type NavLink struct {
+	Title string `toml:"title" yaml:"title"`
+	URL   string `toml:"url" yaml:"url"`
+}
+
+type VersionsConfig struct {
+	Latest string          `toml:"latest,omitempty"` // label of the version also built at the root of output_dir, the first one if empty
+	List   []VersionConfig `toml:"list,omitempty"`   // in the order shown in the version switcher
+}
+
+// VersionConfig is a version of the docs built into output_dir/<label>,
+// without a ref or dir it's built from the project itself
+type VersionConfig struct {
+	Label string `toml:"label"`
+	Ref   string `toml:"ref"` // git ref the docs are read from
+	Dir   string `toml:"dir"` // directory the docs are read from, laid out like the project
+}
+
+// LocaleConfig is a translation of the docs built into output_dir/<lang>,
+// pages with the same path in the doc dirs of two locales are translations of each other
+type LocaleConfig struct {
+	Lang     string   `toml:"lang"`  // language code used for <html lang>, hreflang and the output directory
+	Label    string   `toml:"label"` // name in the language switcher, the lang if empty
+	Title    string   `toml:"title"` // title of the site in this language, title if empty
+	Doc_dirs []string `toml:"doc_dirs"`
+	Entry    string   `toml:"entry"`
 }
 
 type EditorConfig struct {
@@ -83,20 +150,34 @@ func CreateConfig(path string) {
 
 // path is the directory klarity was called with
 func ReadConfig(path string) Config {
-	b, err := os.ReadFile(filepath.Join(path, "klarity.toml"))
+	c, err := loadConfig(path)
 	if err != nil {
 		log.Fatal(err, " ", filepath.Join(path, "klarity.toml"))
 	}
+	return c
+}
 
-	var c Config
-	err = toml.Unmarshal(b, &c)
+// loadConfig is ReadConfig for callers that keep running when the config is broken, like rebuilds
+// of the dev server
+func loadConfig(path string) (Config, error) {
+	b, err := os.ReadFile(filepath.Join(path, "klarity.toml"))
 	if err != nil {
-		log.Fatal(err)
+		return Config{}, err
+	}
+
+	var c Config
+	if err := toml.Unmarshal(b, &c); err != nil {
+		line := 0
+		var perr toml.ParseError
+		if errors.As(err, &perr) {
+			line = perr.Position.Line
+		}
+		return Config{}, &buildError{File: "klarity.toml", Line: line, Err: err}
 	}
 
 	if dev_server {
 		c.Base_URL = "/"
 	}
 
-	return c
+	return c, nil
 }
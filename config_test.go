@@ -3,6 +3,7 @@ package main
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/BurntSushi/toml"
@@ -45,6 +46,17 @@ func TestCreateConfig(t *testing.T) {
 			if err != nil {
 				t.Errorf("CreateConfig() created a klarity.toml that could not be unmarshalled: %v", err)
 			}
+
+			got := ReadConfig(tempDir)
+			if got.Entry != "docs/main.md" || got.Visual.Theme != "rose-pine-moon" || got.Dev.Port != 5173 {
+				t.Errorf("ReadConfig() of the created klarity.toml = %+v", got)
+			}
+			// settings a new project doesn't use are left out instead of written empty
+			for _, key := range []string{"templates_dir", "toc_depth", "host", "tls", "[build]", "[nav]", "[versions]"} {
+				if strings.Contains(string(b), key) {
+					t.Errorf("CreateConfig() wrote %s:\n%s", key, b)
+				}
+			}
 		})
 	}
 }
@@ -96,3 +108,26 @@ func TestReadConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestConfigHash(t *testing.T) {
+	base := Config{Title: "Docs", Doc_dirs: []string{"docs"}}
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		same   bool
+	}{
+		{name: "workers", change: func(c *Config) { c.Build.Workers = 4 }, same: true},
+		{name: "dev port", change: func(c *Config) { c.Dev.Port = 8080 }, same: true},
+		{name: "vars", change: func(c *Config) { c.Visual.Vars.AccentPrimary = "#fff" }, same: true},
+		{name: "title", change: func(c *Config) { c.Title = "Other" }, same: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := base
+			tt.change(&c)
+			if got := configHash(c) == configHash(base); got != tt.same {
+				t.Errorf("hash unchanged = %v, want %v", got, tt.same)
+			}
+		})
+	}
+}
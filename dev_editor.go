@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// where editor.html reads and saves pages while klarity dev runs
+const devEditorPath = "/_klarity/source"
+
+// devEditor lets editor.html save pages straight to the project while klarity dev runs,
+// saved pages are rebuilt by the watcher like any other change. Requests have to be for one of
+// the addresses the server runs on, so pages of other sites can't reach it through DNS rebinding,
+// and carry a token: the one put into the editor page for pages opened on this machine,
+// or the one printed to the terminal for other devices, which can read the page too
+type devEditor struct {
+	root        string
+	token       string
+	remoteToken string
+	config      func() Config
+
+	mu sync.Mutex // a save checks for conflicts and writes in one go
+
+	hostsMu sync.Mutex
+	hosts   []string // host:port of every address the server runs on
+}
+
+// sourceFile is a page as the editor sees it, Version is the hash of the content it was loaded with
+type sourceFile struct {
+	Content string `json:"content"`
+	Version string `json:"version"`
+}
+
+func newDevEditor(root string, config func() Config) (*devEditor, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	// short enough to type in on a phone
+	remote := make([]byte, 8)
+	if _, err := rand.Read(remote); err != nil {
+		return nil, err
+	}
+	return &devEditor{root: root, token: hex.EncodeToString(b), remoteToken: hex.EncodeToString(remote), config: config}, nil
+}
+
+// setURLs sets the addresses requests are accepted for, called whenever the server starts or moves
+func (e *devEditor) setURLs(urls []string) {
+	var hosts []string
+	for _, raw := range urls {
+		u, err := url.Parse(raw)
+		if err != nil {
+			continue
+		}
+		hosts = append(hosts, u.Host)
+		// the names of this machine all reach a server listening on one of them
+		if isLoopbackHost(u.Hostname()) {
+			for _, h := range []string{"localhost", "127.0.0.1", "::1"} {
+				hosts = append(hosts, net.JoinHostPort(h, u.Port()))
+			}
+		}
+	}
+	e.hostsMu.Lock()
+	e.hosts = hosts
+	e.hostsMu.Unlock()
+}
+
+func (e *devEditor) knownHost(host string) bool {
+	e.hostsMu.Lock()
+	defer e.hostsMu.Unlock()
+	return slices.Contains(e.hosts, strings.ToLower(host))
+}
+
+// knownOrigin reports if r comes from a page of the server, requests without an Origin
+// don't come from a browser and only need a known Host
+func (e *devEditor) knownOrigin(r *http.Request) bool {
+	if !e.knownHost(r.Host) {
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && e.knownHost(u.Host)
+}
+
+// validToken reports if r carries a token it may use, the one in the editor page only works from this machine
+func (e *devEditor) validToken(r *http.Request) bool {
+	got := []byte(r.Header.Get("X-Klarity-Token"))
+	if subtle.ConstantTimeCompare(got, []byte(e.remoteToken)) == 1 {
+		return true
+	}
+	return localClient(r) && subtle.ConstantTimeCompare(got, []byte(e.token)) == 1
+}
+
+// localClient reports if r was made from this machine
+func localClient(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	ip := net.ParseIP(host)
+	return err == nil && ip != nil && ip.IsLoopback()
+}
+
+// inject gives the editor page the address of the API and the token for it, pages opened from
+// other devices ask for the token printed to the terminal instead, pages for unknown hosts can't save
+func (e *devEditor) inject(r *http.Request, html string) string {
+	if !e.knownHost(r.Host) {
+		return html
+	}
+	token := ""
+	if localClient(r) {
+		token = e.token
+	}
+	b, _ := json.Marshal(map[string]string{"api": devEditorPath, "token": token})
+	script := `<script>window.klarityDev = ` + string(b) + `;</script>`
+	if strings.Contains(html, "</head>") {
+		return strings.Replace(html, "</head>", script+"</head>", 1)
+	}
+	return script + html
+}
+
+func (e *devEditor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// checked on every request, enable_editor can change while the server runs
+	if !e.config().Editor.Enable {
+		http.NotFound(w, r)
+		return
+	}
+	if !e.knownHost(r.Host) {
+		http.Error(w, "unknown host", http.StatusForbidden)
+		return
+	}
+	if !e.validToken(r) {
+		http.Error(w, "invalid token", http.StatusForbidden)
+		return
+	}
+	path, err := e.source(r.URL.Query().Get("file"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		b, err := os.ReadFile(path)
+		if err != nil {
+			http.Error(w, "file not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, sourceFile{Content: string(b), Version: hashBytes(b)})
+	case http.MethodPut:
+		var req sourceFile
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16<<20)).Decode(&req); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		saved, current, err := e.save(path, req)
+		switch {
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		case !saved:
+			// changed on disk since the editor loaded it, the editor decides what to keep
+			writeJSON(w, http.StatusConflict, current)
+		default:
+			fmt.Println("[Klarity] Saved from the editor:", path)
+			writeJSON(w, http.StatusOK, map[string]string{"version": current.Version})
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// source resolves file, relative to the project root, to a page in the doc dirs of the project
+// or one of its versions
+func (e *devEditor) source(file string) (string, error) {
+	file = filepath.FromSlash(file)
+	if !filepath.IsLocal(file) || filepath.Ext(file) != ".md" {
+		return "", errors.New("only markdown files in the project can be edited")
+	}
+	if !isPageSource(e.config(), file) {
+		return "", errors.New("only pages in doc_dirs can be edited")
+	}
+	return filepath.Join(e.root, file), nil
+}
+
+// save writes req to path if the file still has the version req was loaded with, otherwise
+// it returns false and what is on disk now
+func (e *devEditor) save(path string, req sourceFile) (bool, sourceFile, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	old, err := os.ReadFile(path)
+	if err != nil {
+		return false, sourceFile{}, err
+	}
+	if hashBytes(old) != req.Version {
+		return false, sourceFile{Content: string(old), Version: hashBytes(old)}, nil
+	}
+
+	if err := writeFileAtomic(path, []byte(req.Content)); err != nil {
+		return false, sourceFile{}, err
+	}
+	return true, sourceFile{Version: hashBytes([]byte(req.Content))}, nil
+}
+
+// writeFileAtomic replaces path with b through a temporary file next to it, so the file
+// is never seen half written, the temporary file is hidden from the dev server watcher
+func writeFileAtomic(path string, b []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	tmp, err := stageFile(filepath.Dir(path), b, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDevEditor(t *testing.T) {
+	root := createTempDir(t)
+	defer os.RemoveAll(root)
+	writeTestDocs(t, root, map[string]string{"docs/page.md": "# Page", "notes.md": "# Notes"})
+
+	c := Config{Doc_dirs: []string{"docs"}}
+	e, err := newDevEditor(root, func() Config { return c })
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.setURLs([]string{"http://localhost:5173", "http://192.168.1.2:5173"})
+	loaded := hashBytes([]byte("# Page"))
+
+	tests := []struct {
+		name   string
+		method string
+		file   string
+		token  string
+		host   string // localhost:5173 if empty
+		remote string // where the request comes from, this machine if empty
+		off    bool   // enable_editor = false
+		body   string
+		want   int
+		wantMD string
+	}{
+		{name: "editor disabled", method: "PUT", file: "docs/page.md", off: true, body: `{"content": "# Saved", "version": "` + loaded + `"}`, want: http.StatusNotFound, wantMD: "# Page"},
+		{name: "wrong token", method: "GET", file: "docs/page.md", token: "nope", want: http.StatusForbidden, wantMD: "# Page"},
+		{name: "unknown host", method: "GET", file: "docs/page.md", host: "evil.example:5173", want: http.StatusForbidden, wantMD: "# Page"},
+		{name: "other device with the page token", method: "GET", file: "docs/page.md", host: "192.168.1.2:5173", remote: "192.168.1.3:50000", want: http.StatusForbidden, wantMD: "# Page"},
+		{name: "other device with the terminal token", method: "GET", file: "docs/page.md", token: e.remoteToken, host: "192.168.1.2:5173", remote: "192.168.1.3:50000", want: http.StatusOK, wantMD: "# Page"},
+		{name: "loopback alias", method: "GET", file: "docs/page.md", host: "127.0.0.1:5173", want: http.StatusOK, wantMD: "# Page"},
+		{name: "outside doc_dirs", method: "GET", file: "notes.md", want: http.StatusBadRequest, wantMD: "# Page"},
+		{name: "escaping the project", method: "GET", file: "docs/../../page.md", want: http.StatusBadRequest, wantMD: "# Page"},
+		{name: "not markdown", method: "GET", file: "docs/page.txt", want: http.StatusBadRequest, wantMD: "# Page"},
+		{name: "load", method: "GET", file: "docs/page.md", want: http.StatusOK, wantMD: "# Page"},
+		{name: "save", method: "PUT", file: "docs/page.md", body: `{"content": "# Saved", "version": "` + loaded + `"}`, want: http.StatusOK, wantMD: "# Saved"},
+		{name: "conflict", method: "PUT", file: "docs/page.md", body: `{"content": "# Stale", "version": "` + loaded + `"}`, want: http.StatusConflict, wantMD: "# Saved"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c.Editor.Enable = !tt.off
+			req := httptest.NewRequest(tt.method, devEditorPath+"?file="+tt.file, strings.NewReader(tt.body))
+			req.Header.Set("X-Klarity-Token", cmp.Or(tt.token, e.token))
+			req.Host = cmp.Or(tt.host, "localhost:5173")
+			req.RemoteAddr = cmp.Or(tt.remote, "127.0.0.1:50000")
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			if b, _ := os.ReadFile(filepath.Join(root, "docs", "page.md")); string(b) != tt.wantMD {
+				t.Errorf("page = %q, want %q", b, tt.wantMD)
+			}
+			if tt.want == http.StatusConflict {
+				var current sourceFile
+				json.Unmarshal(rec.Body.Bytes(), &current)
+				if current.Content != "# Saved" || current.Version != hashBytes([]byte("# Saved")) {
+					t.Errorf("conflict = %+v, want the content on disk", current)
+				}
+			}
+		})
+	}
+}
+
+func TestDevEditorInject(t *testing.T) {
+	e, err := newDevEditor(createTempDir(t), func() Config { return Config{} })
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.setURLs([]string{"http://localhost:5173", "http://192.168.1.2:5173"})
+
+	tests := []struct {
+		name   string
+		host   string
+		remote string
+		want   string // token in the page, empty for none
+		inject bool
+	}{
+		{name: "this machine", host: "localhost:5173", remote: "127.0.0.1:50000", want: e.token, inject: true},
+		{name: "other device", host: "192.168.1.2:5173", remote: "192.168.1.3:50000", inject: true},
+		{name: "unknown host", host: "evil.example:5173", remote: "127.0.0.1:50000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/editor.html", nil)
+			req.Host, req.RemoteAddr = tt.host, tt.remote
+			got := e.inject(req, "<head></head>")
+
+			if strings.Contains(got, "klarityDev") != tt.inject {
+				t.Fatalf("injected = %v, want %v: %s", !tt.inject, tt.inject, got)
+			}
+			if strings.Contains(got, e.remoteToken) {
+				t.Error("the terminal token is in the page")
+			}
+			if tt.inject && !strings.Contains(got, `"token":"`+tt.want+`"`) {
+				t.Errorf("page = %s, want token %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDevEditorKnownOrigin(t *testing.T) {
+	e, err := newDevEditor(createTempDir(t), func() Config { return Config{} })
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.setURLs([]string{"http://localhost:5173", "http://192.168.1.2:5173"})
+
+	tests := []struct {
+		name   string
+		host   string
+		origin string
+		want   bool
+	}{
+		{name: "page of the server", host: "localhost:5173", origin: "http://localhost:5173", want: true},
+		{name: "other device", host: "192.168.1.2:5173", origin: "http://192.168.1.2:5173", want: true},
+		{name: "no origin", host: "localhost:5173", want: true},
+		{name: "other site", host: "localhost:5173", origin: "https://evil.example"},
+		{name: "rebound host", host: "evil.example:5173", origin: "http://evil.example:5173"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/klarity-livereload", nil)
+			req.Host = tt.host
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if got := e.knownOrigin(req); got != tt.want {
+				t.Errorf("knownOrigin() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
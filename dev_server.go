@@ -1,27 +1,35 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/exec"
 	"os/signal"
 	"path/filepath"
-	"slices"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/alecthomas/kong"
-	"github.com/fsnotify/fsnotify"
 	"github.com/gorilla/websocket"
 )
 
 type wsHub struct {
-	mu      sync.Mutex
-	clients map[*websocket.Conn]struct{}
+	mu        sync.Mutex
+	clients   map[*websocket.Conn]struct{}
+	lastError []byte // the error of the last build if it failed, sent to pages as they connect
 }
 
 func newWsHub() *wsHub {
@@ -34,6 +42,10 @@ func (h *wsHub) add(conn *websocket.Conn) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 	h.clients[conn] = struct{}{}
+	if h.lastError != nil {
+		conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+		conn.WriteMessage(websocket.TextMessage, h.lastError)
+	}
 }
 
 func (h *wsHub) remove(conn *websocket.Conn) {
@@ -42,12 +54,57 @@ func (h *wsHub) remove(conn *websocket.Conn) {
 	delete(h.clients, conn)
 }
 
-func (h *wsHub) broadcast(msg string) {
+// devMessage tells open pages what changed, pages are swapped in place unless Type is "reload"
+type devMessage struct {
+	Type  string    `json:"type"`          // "reload", "update", "search", "error" or "moved"
+	URL   string    `json:"url,omitempty"` // where the dev server moved to
+	Pages []string  `json:"pages,omitempty"`
+	CSS   []string  `json:"css,omitempty"`
+	Nav   bool      `json:"nav,omitempty"`
+	Error *devError `json:"error,omitempty"`
+}
+
+// devError is a failed rebuild, shown over the page until a build succeeds
+type devError struct {
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Message string `json:"message"`
+}
+
+func newDevError(err error) *devError {
+	e := &devError{Message: err.Error()}
+	var berr *buildError
+	if errors.As(err, &berr) {
+		e.File, e.Line = berr.File, berr.Line
+	}
+	return e
+}
+
+// failed reports if the last build failed, the next one that succeeds has to clear the error
+// even if it didn't change anything
+func (h *wsHub) failed() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.lastError != nil
+}
+
+func (h *wsHub) broadcast(msg devMessage) {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+
 	h.mu.Lock()
 	defer h.mu.Unlock()
+	switch msg.Type {
+	case "error":
+		h.lastError = b
+	case "update", "reload":
+		h.lastError = nil
+	}
 	for c := range h.clients {
 		c.SetWriteDeadline(time.Now().Add(2 * time.Second))
-		if err := c.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+		if err := c.WriteMessage(websocket.TextMessage, b); err != nil {
 			c.Close()
 			delete(h.clients, c)
 		}
@@ -56,68 +113,49 @@ func (h *wsHub) broadcast(msg string) {
 
 var dev_server = false
 
+// the dev server builds into the build cache instead of output_dir, so it never overwrites
+// the output of klarity build, klarity clean removes it with the rest of the cache
+var devOutputDir = filepath.Join(cacheDir, "cache", "dev")
+
 func (d *DevServer) Run(ctx *kong.Context) error {
 	dev_server = true
-	pwd = d.Path
-	InitMarkdown(pwd)
 	projectPath, err := filepath.Abs(d.Path)
 	if err != nil {
 		return fmt.Errorf("failed to resolve path: %w", err)
 	}
 
-	if err := buildKlarity(projectPath); err != nil {
-		return fmt.Errorf("initial build failed: %w", err)
+	hub := newWsHub()
+
+	changes := &devChanges{}
+	opts := buildOptions{NoSearch: d.NoSearch, OnBuilt: changes.add, OutputDir: devOutputDir, Cache: "dev"}
+	var search *devSearch
+	if !d.NoSearch {
+		search = newDevSearch(hub)
+		opts.OnSearch = search.queue
 	}
 
-	cfg := ReadConfig(projectPath)
-	outputDir, err := filepath.Abs(filepath.Join(projectPath, cfg.Output_dir))
-	if err != nil {
-		return fmt.Errorf("failed to get output dir: %w", err)
+	if err := buildKlarity(projectPath, opts); err != nil {
+		return fmt.Errorf("initial build failed: %w", err)
 	}
+	changes.take()
 
-	hub := newWsHub()
+	cfg := ReadConfig(projectPath)
+	outputDir := filepath.Join(projectPath, devOutputDir)
 
-	watcher, err := fsnotify.NewWatcher()
+	watcher, err := newDevWatcher(projectPath, cfg)
 	if err != nil {
 		return fmt.Errorf("watcher error: %w", err)
 	}
 	defer watcher.Close()
 
-	watchDirs := []string{projectPath}
-	for _, dir := range cfg.Doc_dirs {
-		watchDirs = append(watchDirs, filepath.Join(projectPath, dir))
-	}
-	for _, dir := range watchDirs {
-		filepath.Walk(dir, func(path string, info os.FileInfo, _ error) error {
-			if info == nil {
-				return nil
-			}
-			if info.IsDir() {
-				watcher.Add(path)
-			}
-			return nil
-		})
-	}
-
-	var debounceTimer *time.Timer
-	var mu sync.Mutex
-	triggerRebuild := func() {
-		mu.Lock()
-		defer mu.Unlock()
-		if debounceTimer != nil {
-			debounceTimer.Stop()
-		}
-		debounceTimer = time.AfterFunc(400*time.Millisecond, func() {
-			fmt.Println("[Klarity] Change detected, rebuilding...")
-			if err := buildKlarity(projectPath); err != nil {
-				fmt.Printf("[Klarity] Rebuild error: %v\n", err)
-			} else {
-				hub.broadcast("reload")
-			}
-		})
+	editor, err := newDevEditor(projectPath, watcher.config)
+	if err != nil {
+		return fmt.Errorf("editor error: %w", err)
 	}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	mux := http.NewServeMux()
+	mux.Handle(devEditorPath, editor)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		p := r.URL.Path
 		if p == "/" {
 			p = "/index.html"
@@ -134,6 +172,12 @@ func (d *DevServer) Run(ctx *kong.Context) error {
 				return
 			}
 			mod := injectLiveReload(string(raw))
+			if filepath.Base(file) == "editor.html" {
+				mod = editor.inject(r, mod)
+			}
+			if search != nil {
+				mod = search.inject(file, mod)
+			}
 			w.Header().Set("Content-Type", "text/html")
 			w.Write([]byte(mod))
 			return
@@ -141,10 +185,9 @@ func (d *DevServer) Run(ctx *kong.Context) error {
 		http.ServeFile(w, r, file)
 	})
 
-	http.HandleFunc("/klarity-livereload", func(w http.ResponseWriter, r *http.Request) {
-		upgrader := websocket.Upgrader{
-			CheckOrigin: func(r *http.Request) bool { return true },
-		}
+	mux.HandleFunc("/klarity-livereload", func(w http.ResponseWriter, r *http.Request) {
+		// the socket carries build errors with file paths and source lines, only pages of this server get them
+		upgrader := websocket.Upgrader{CheckOrigin: editor.knownOrigin}
 		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			log.Println("ws upgrade:", err)
@@ -160,72 +203,109 @@ func (d *DevServer) Run(ctx *kong.Context) error {
 		}
 	})
 
-	srv := &http.Server{Addr: "localhost:5173"}
-	if cfg.Dev.Port != 0 && cfg.Dev.Port > 1024 && cfg.Dev.Port < 49151 {
-		srv.Addr = fmt.Sprintf("localhost:%d", cfg.Dev.Port)
+	dc, err := d.devConfig(projectPath, cfg)
+	if err != nil {
+		return err
+	}
+	srv, err := startDevServer(projectPath, dc, mux)
+	if err != nil {
+		return fmt.Errorf("failed to start the dev server: %w", err)
 	}
+	var srvMu sync.Mutex
+	editor.setURLs(srv.urls)
 
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	// other devices can open the editor when the server is reachable from the network,
+	// they need the token it prints to save
+	printEditorToken := func() {
+		if watcher.config().Editor.Enable && !isLoopbackHost(srv.conf.Host) {
+			fmt.Println("[Klarity] Editor token for other devices:", editor.remoteToken)
+		}
+	}
 
-	done := make(chan struct{})
+	// moveServer restarts the server when [dev] changed, open pages follow it to the new address
+	moveServer := func(c Config) {
+		srvMu.Lock()
+		defer srvMu.Unlock()
+		// the flags are checked at startup, only the config changes here and it always falls back
+		dc, _ := d.devConfig(projectPath, c)
+		if dc == srv.conf {
+			return
+		}
+		// the old server has to let go of the port first, the new one may use the same
+		srv.Close()
+		next, err := startDevServer(projectPath, dc, mux)
+		if err != nil {
+			fmt.Printf("[Klarity] Can't move the dev server: %v\n", err)
+			if next, err = startDevServer(projectPath, srv.conf, mux); err != nil {
+				fmt.Printf("[Klarity] Can't restart the dev server: %v\n", err)
+				return
+			}
+		}
+		srv = next
+		editor.setURLs(srv.urls)
+		srv.printURLs("[Klarity] Dev server moved to")
+		printEditorToken()
+		hub.broadcast(devMessage{Type: "moved", URL: srv.urls[0]})
+	}
 
-	go func() {
-		for {
-			select {
-			case event, ok := <-watcher.Events:
-				if !ok {
-					return
-				}
-				isMd := strings.HasSuffix(event.Name, ".md")
-				isToml := strings.HasSuffix(event.Name, ".toml")
-
-				if isMd || isToml {
-					if event.Op&fsnotify.Create == fsnotify.Create {
-						fmt.Println("[Watcher] Detected new file:", event.Name)
-						triggerRebuild()
-					}
-					if event.Op&fsnotify.Write == fsnotify.Write {
-						fmt.Println("[Watcher] Detected modification:", event.Name)
-						triggerRebuild()
-					}
-					if event.Op&fsnotify.Remove == fsnotify.Remove {
-						fmt.Println("[Watcher] Detected deletion:", event.Name)
-						triggerRebuild()
-					}
-				}
+	var debounceTimer *time.Timer
+	var mu sync.Mutex
+	var buildMu sync.Mutex
+	configChanged := false
+	triggerRebuild := func(config bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		configChanged = configChanged || config
+		if debounceTimer != nil {
+			debounceTimer.Stop()
+		}
+		debounceTimer = time.AfterFunc(400*time.Millisecond, func() {
+			mu.Lock()
+			config := configChanged
+			configChanged = false
+			mu.Unlock()
 
-				// TODO: add a check for cfg.Doc_dirs
-				if event.Op&fsnotify.Create == fsnotify.Create {
-					info, err := os.Stat(event.Name)
-					if err == nil && info.IsDir() && slices.Contains(cfg.Doc_dirs, info.Name()) {
-						watcher.Add(event.Name)
-						filepath.Walk(event.Name, func(path string, info os.FileInfo, _ error) error {
-							if info != nil && info.IsDir() {
-								watcher.Add(path)
-							}
-							return nil
-						})
-					}
-				}
-			case err, ok := <-watcher.Errors:
-				if !ok {
-					return
+			// a build that takes longer than the debounce isn't overlapped by the next one
+			buildMu.Lock()
+			defer buildMu.Unlock()
+
+			// a broken config is reported by the build, the old one is kept until it's fixed
+			if config {
+				if c, err := loadConfig(projectPath); err == nil {
+					watcher.setConfig(c)
+					moveServer(c)
 				}
-				log.Println("[Klarity] Watcher error:", err)
-			case <-done:
-				return
 			}
-		}
-	}()
 
-	go func() {
-		fmt.Printf("[Klarity] Dev server running on http://%s\n", srv.Addr)
-		fmt.Println("[Klarity] Watching for changes...")
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("[Klarity] HTTP server error: %v", err)
+			fmt.Println("[Klarity] Change detected, rebuilding...")
+			// sites built before a failure keep their changes for the next build that succeeds
+			if err := buildKlarity(projectPath, opts); err != nil {
+				fmt.Printf("[Klarity] Rebuild error: %v\n", err)
+				hub.broadcast(devMessage{Type: "error", Error: newDevError(err)})
+			} else if msg, ok := changes.take(); ok || hub.failed() {
+				hub.broadcast(msg)
+			}
+		})
+	}
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+
+	done := make(chan struct{})
+
+	if search != nil {
+		go search.run(done)
+	}
+	go watcher.run(done, triggerRebuild)
+
+	srv.printURLs("[Klarity] Dev server running on")
+	printEditorToken()
+	fmt.Println("[Klarity] Watching for changes...")
+	if d.Open {
+		if err := openBrowser(srv.urls[0]); err != nil {
+			fmt.Printf("[Klarity] Can't open the browser: %v\n", err)
 		}
-	}()
+	}
 
 	<-quit
 	fmt.Println("[Klarity] Shutting down...")
@@ -236,6 +316,8 @@ func (d *DevServer) Run(ctx *kong.Context) error {
 	// Graceful HTTP shutdown
 	ctxTimeout, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
+	srvMu.Lock()
+	defer srvMu.Unlock()
 	if err := srv.Shutdown(ctxTimeout); err != nil {
 		log.Printf("[Klarity] HTTP server shutdown error: %v", err)
 	}
@@ -244,12 +326,240 @@ func (d *DevServer) Run(ctx *kong.Context) error {
 	return nil
 }
 
+// ports tried after the configured one when it's taken
+const devPortAttempts = 10
+
+// the ports the dev server uses, above the well-known ones and below the ephemeral range
+const (
+	devPortMin = 1025
+	devPortMax = 49150
+)
+
+// devConfig is [dev] with the flags of klarity dev applied over it, paths made absolute
+// and defaults filled in, a port from the config that is out of range falls back to the default,
+// one passed with --port is an error
+func (d *DevServer) devConfig(root string, c Config) (DevConfig, error) {
+	dc := c.Dev
+	if dc.TLSCert != "" {
+		dc.TLSCert = filepath.Join(root, dc.TLSCert)
+	}
+	if dc.TLSKey != "" {
+		dc.TLSKey = filepath.Join(root, dc.TLSKey)
+	}
+
+	if d.Host != "" {
+		dc.Host = d.Host
+	}
+	if d.Port != 0 {
+		if d.Port < devPortMin || d.Port > devPortMax {
+			return DevConfig{}, fmt.Errorf("--port %d is out of range, use a port from %d to %d", d.Port, devPortMin, devPortMax)
+		}
+		dc.Port = d.Port
+	}
+	if d.TLSCert != "" || d.TLSKey != "" {
+		dc.TLSCert, dc.TLSKey = d.TLSCert, d.TLSKey
+	}
+	dc.TLS = dc.TLS || d.TLS || dc.TLSCert != ""
+
+	if dc.Host == "" {
+		dc.Host = "localhost"
+	}
+	if dc.Port < devPortMin || dc.Port > devPortMax {
+		dc.Port = 5173
+	}
+	return dc, nil
+}
+
+// devHTTP is a running dev server
+type devHTTP struct {
+	*http.Server
+	conf DevConfig // what the server was started with, it's moved when this changes
+	urls []string  // where the server can be opened, the first one on this machine
+}
+
+// startDevServer listens before returning, so a server that can't start is reported to the caller,
+// the next free port is used if the configured one is taken
+func startDevServer(root string, dc DevConfig, handler http.Handler) (*devHTTP, error) {
+	var tlsConfig *tls.Config
+	if dc.TLS {
+		cert, err := devCertificate(root, dc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the TLS certificate: %w", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	var ln net.Listener
+	var firstErr error
+	port := dc.Port
+	for i := range min(devPortAttempts, devPortMax-dc.Port+1) {
+		l, err := net.Listen("tcp", net.JoinHostPort(dc.Host, strconv.Itoa(dc.Port+i)))
+		if err == nil {
+			ln, port = l, dc.Port+i
+			break
+		}
+		firstErr = cmp.Or(firstErr, err)
+	}
+	if ln == nil {
+		return nil, firstErr
+	}
+	if port != dc.Port {
+		fmt.Printf("[Klarity] Port %d is in use, using %d instead\n", dc.Port, port)
+	}
+
+	scheme := "http"
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+		scheme = "https"
+	}
+	srv := &http.Server{Addr: ln.Addr().String(), Handler: handler}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Printf("[Klarity] HTTP server error: %v", err)
+		}
+	}()
+
+	hosts := []string{dc.Host}
+	if listensEverywhere(dc.Host) {
+		hosts = append([]string{"localhost"}, lanAddrs()...)
+	}
+	var urls []string
+	for _, h := range hosts {
+		urls = append(urls, scheme+"://"+net.JoinHostPort(h, strconv.Itoa(port)))
+	}
+	return &devHTTP{Server: srv, conf: dc, urls: urls}, nil
+}
+
+func (s *devHTTP) printURLs(prefix string) {
+	fmt.Println(prefix, s.urls[0])
+	for _, u := range s.urls[1:] {
+		fmt.Println("[Klarity] On your network:", u)
+	}
+}
+
+func openBrowser(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	return cmd.Start()
+}
+
+// devChanges collects what the sites of a build changed, a build with versions or locales
+// builds several of them
+type devChanges struct {
+	mu    sync.Mutex
+	sites []buildChanges
+}
+
+func (d *devChanges) add(c buildChanges) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sites = append(d.sites, c)
+}
+
+// take returns the message for the changes collected since the last take,
+// false if nothing open pages show changed
+func (d *devChanges) take() (devMessage, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	sites := d.sites
+	d.sites = nil
+
+	msg := devMessage{Type: "update"}
+	for _, c := range sites {
+		if c.Reload {
+			return devMessage{Type: "reload"}, true
+		}
+		msg.Pages = append(msg.Pages, c.Pages...)
+		msg.CSS = append(msg.CSS, c.CSS...)
+		msg.Nav = msg.Nav || c.Nav
+	}
+	return msg, len(msg.Pages) > 0 || len(msg.CSS) > 0 || msg.Nav
+}
+
 func injectLiveReload(html string) string {
 	script := `<script>
 (function() {
 	var ws = new WebSocket((location.protocol === 'https:' ? 'wss://' : 'ws://') + location.host + '/klarity-livereload');
+	var path = function(url) {
+		return new URL(url, location.href).pathname.replace(/index\.html$/, '');
+	};
+	var overlay = null;
+	var hideError = function() {
+		if (overlay) overlay.remove();
+		overlay = null;
+	};
+	var showError = function(err) {
+		hideError();
+		overlay = document.createElement('div');
+		overlay.id = 'klarity-error-overlay';
+		overlay.style.cssText = 'position:fixed;inset:0;z-index:10000;overflow:auto;padding:2rem;background:rgba(0,0,0,.85);color:#eee;font:14px/1.5 monospace';
+		var title = document.createElement('div');
+		title.style.cssText = 'color:#ff6b6b;font-weight:bold;margin-bottom:1rem';
+		title.textContent = 'Build failed' + (err.file ? ' in ' + err.file + (err.line ? ':' + err.line : '') : '');
+		var message = document.createElement('pre');
+		message.style.cssText = 'white-space:pre-wrap;margin:0';
+		message.textContent = err.message;
+		var close = document.createElement('button');
+		close.style.cssText = 'position:absolute;top:1rem;right:1rem;background:none;border:0;color:inherit;font-size:1.5rem;cursor:pointer';
+		close.textContent = '×';
+		close.title = 'Hide until the next build';
+		close.onclick = hideError;
+		overlay.append(close, title, message);
+		document.body.appendChild(overlay);
+	};
+	var swapPage = function(nav) {
+		if (typeof initContent !== 'function' || typeof initNav !== 'function') return location.reload();
+		fetch(location.href, { cache: 'no-store' }).then(function(res) {
+			if (!res.ok) throw new Error(res.statusText);
+			return res.text();
+		}).then(function(html) {
+			var doc = new DOMParser().parseFromString(html, 'text/html');
+			var parts = ['#swup', '#toc'];
+			if (nav) parts.push('#nav-sidebar nav');
+			parts.forEach(function(sel) {
+				var from = doc.querySelector(sel), to = document.querySelector(sel);
+				if (from && to) to.innerHTML = from.innerHTML;
+			});
+			document.title = doc.title;
+			if (nav) initNav();
+			initContent();
+		}).catch(function() {
+			location.reload();
+		});
+	};
+	var swapCSS = function(urls) {
+		document.querySelectorAll('link[rel="stylesheet"]').forEach(function(link) {
+			if (urls.indexOf(path(link.href)) < 0) return;
+			var url = new URL(link.href);
+			url.searchParams.set('t', Date.now());
+			var next = link.cloneNode();
+			next.href = url.href;
+			next.onload = next.onerror = function() { link.remove(); };
+			link.after(next);
+		});
+	};
 	ws.onmessage = function(event) {
-		if (event.data === 'reload') location.reload();
+		var msg = JSON.parse(event.data);
+		if (msg.type === 'error') return showError(msg.error);
+		if (msg.type === 'moved') {
+			// keep the host the page was opened at, other devices can't reach localhost
+			var to = new URL(msg.url);
+			to.hostname = location.hostname;
+			return location.href = to.origin + location.pathname + location.search + location.hash;
+		}
+		if (msg.type === 'reload') location.reload();
+		if (msg.type === 'search') window.dispatchEvent(new Event('klarity:search-updated'));
+		if (msg.type !== 'update') return;
+		hideError();
+		if (msg.css) swapCSS(msg.css.map(path));
+		if (msg.pages && msg.pages.map(path).indexOf(path(location.href)) >= 0) swapPage(msg.nav);
 	};
 })();
 </script>`
@@ -258,3 +568,110 @@ func injectLiveReload(html string) string {
 	}
 	return html + script
 }
+
+// devSearch indexes the sites built by the dev server in the background with the built-in engine,
+// pagefind can only index a whole site at once, which is too slow to run after every change
+type devSearch struct {
+	hub      *wsHub
+	wake     chan struct{}
+	indexers map[string]*searchIndexer // only used by run
+
+	mu      sync.Mutex
+	pending map[string]searchJob // latest job of each site by output dir
+	ui      map[string]string    // search UI of each site by output dir
+}
+
+func newDevSearch(hub *wsHub) *devSearch {
+	return &devSearch{
+		hub:      hub,
+		wake:     make(chan struct{}, 1),
+		indexers: make(map[string]*searchIndexer),
+		pending:  make(map[string]searchJob),
+		ui:       make(map[string]string),
+	}
+}
+
+// queue is the buildOptions.OnSearch of the dev server, a job replaces the one of the same site
+// if that wasn't indexed yet
+func (d *devSearch) queue(job searchJob) {
+	var buf bytes.Buffer
+	data := searchData{BundlePath: job.baseURL + "/" + searchIndexDir + "/", Engine: "builtin"}
+	err := job.tpl.Execute(&buf, data)
+	if err != nil {
+		fmt.Printf("[Klarity] Search UI error: %v\n", err)
+	}
+
+	d.mu.Lock()
+	d.pending[job.outputDir] = job
+	if err == nil {
+		d.ui[job.outputDir] = buf.String()
+	}
+	d.mu.Unlock()
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run indexes the queued sites until done is closed, open pages are told to search again
+// once an index changed
+func (d *devSearch) run(done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-d.wake:
+		}
+
+		d.mu.Lock()
+		jobs := d.pending
+		d.pending = make(map[string]searchJob)
+		d.mu.Unlock()
+
+		updated := false
+		for dir, job := range jobs {
+			start := time.Now()
+			ix := d.indexers[dir]
+			// a full rebuild starts from an empty output dir, so the index has to be written again
+			if _, err := os.Stat(filepath.Join(dir, searchIndexDir, "meta.json")); ix == nil || err != nil {
+				ix = newSearchIndexer(filepath.Join(dir, searchIndexDir))
+				d.indexers[dir] = ix
+			}
+			changed := ix.update(job.pages)
+			if err := ix.flush(); err != nil {
+				fmt.Printf("[Klarity] Search index error: %v\n", err)
+				continue
+			}
+			if changed {
+				updated = true
+				fmt.Printf("[Klarity] Search index updated in %s\n", time.Since(start).Round(time.Millisecond))
+			}
+		}
+		if updated {
+			d.hub.broadcast(devMessage{Type: "search"})
+		}
+	}
+}
+
+// inject adds the search UI of the site file belongs to into html
+func (d *devSearch) inject(file, html string) string {
+	if filepath.Base(file) == "editor.html" || strings.Contains(html, `id="klarity-search-floating"`) {
+		return html
+	}
+
+	d.mu.Lock()
+	site := ""
+	for dir := range d.ui {
+		if strings.HasPrefix(file, dir+string(filepath.Separator)) && len(dir) > len(site) {
+			site = dir
+		}
+	}
+	ui := d.ui[site]
+	d.mu.Unlock()
+
+	if ui == "" || !strings.Contains(html, "</body>") {
+		return html
+	}
+	return strings.Replace(html, "</body>", ui+"</body>", 1)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDevConfig(t *testing.T) {
+	root := filepath.FromSlash("/project")
+
+	tests := []struct {
+		name    string
+		dev     DevConfig
+		flags   DevServer
+		want    DevConfig
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			want: DevConfig{Host: "localhost", Port: 5173},
+		},
+		{
+			name: "config port out of range",
+			dev:  DevConfig{Port: 80},
+			want: DevConfig{Host: "localhost", Port: 5173},
+		},
+		{
+			name:    "flag out of range",
+			flags:   DevServer{Port: 50000},
+			wantErr: true,
+		},
+		{
+			name: "config",
+			dev:  DevConfig{Host: "0.0.0.0", Port: 4000, TLSCert: "cert.pem", TLSKey: "key.pem"},
+			want: DevConfig{Host: "0.0.0.0", Port: 4000, TLS: true, TLSCert: filepath.Join(root, "cert.pem"), TLSKey: filepath.Join(root, "key.pem")},
+		},
+		{
+			name:  "flags override the config",
+			dev:   DevConfig{Host: "0.0.0.0", Port: 4000, TLSCert: "cert.pem", TLSKey: "key.pem"},
+			flags: DevServer{Host: "127.0.0.1", Port: 4500, TLSCert: "/tmp/c.pem", TLSKey: "/tmp/k.pem"},
+			want:  DevConfig{Host: "127.0.0.1", Port: 4500, TLS: true, TLSCert: "/tmp/c.pem", TLSKey: "/tmp/k.pem"},
+		},
+		{
+			name:  "self-signed",
+			flags: DevServer{TLS: true},
+			want:  DevConfig{Host: "localhost", Port: 5173, TLS: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.flags.devConfig(root, Config{Dev: tt.dev})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("devConfig() error = %v, want an error: %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("devConfig() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDevCertificate(t *testing.T) {
+	root := createTempDir(t)
+	defer os.RemoveAll(root)
+
+	dc := DevConfig{Host: "localhost", TLS: true}
+	first, err := devCertificate(root, dc)
+	if err != nil {
+		t.Fatalf("devCertificate() error = %v", err)
+	}
+	if !certCovers(first, []string{"localhost", "127.0.0.1"}) {
+		t.Errorf("self-signed certificate doesn't cover localhost")
+	}
+
+	second, err := devCertificate(root, dc)
+	if err != nil {
+		t.Fatalf("devCertificate() error = %v", err)
+	}
+	if !bytes.Equal(first.Certificate[0], second.Certificate[0]) {
+		t.Errorf("devCertificate() made a new certificate instead of reusing the saved one")
+	}
+
+	dc.Host = "192.0.2.10"
+	third, err := devCertificate(root, dc)
+	if err != nil {
+		t.Fatalf("devCertificate() error = %v", err)
+	}
+	if !certCovers(third, []string{"192.0.2.10"}) {
+		t.Errorf("certificate wasn't made again for a new host")
+	}
+}
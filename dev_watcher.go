@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// devWatcher watches the project for changes to the files a build reads, every directory of the
+// project is watched so static_dirs, templates and new doc dirs are picked up wherever they are
+type devWatcher struct {
+	root    string
+	watcher *fsnotify.Watcher
+
+	mu     sync.Mutex
+	cfg    Config // read again when klarity.toml changes
+	rescan *time.Timer
+}
+
+func newDevWatcher(root string, cfg Config) (*devWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	w := &devWatcher{root: root, watcher: watcher, cfg: cfg}
+	w.add(root)
+	return w, nil
+}
+
+func (w *devWatcher) Close() error {
+	return w.watcher.Close()
+}
+
+func (w *devWatcher) config() Config {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.cfg
+}
+
+// setConfig switches to the config of the latest klarity.toml, output_dir may have moved
+// so the directories that are ignored are checked again
+func (w *devWatcher) setConfig(c Config) {
+	w.mu.Lock()
+	w.cfg = c
+	w.mu.Unlock()
+
+	for _, dir := range w.watcher.WatchList() {
+		if w.ignored(dir) {
+			w.watcher.Remove(dir)
+		}
+	}
+	w.add(w.root)
+}
+
+// ignored reports directories that are never watched, hidden ones like .git and .klarity,
+// where the dev server builds to, output_dir which klarity build writes to and node_modules
+func (w *devWatcher) ignored(dir string) bool {
+	rel, err := filepath.Rel(w.root, dir)
+	if err != nil || rel == "." {
+		return false
+	}
+	if base := filepath.Base(dir); strings.HasPrefix(base, ".") || base == "node_modules" {
+		return true
+	}
+	out := filepath.Clean(w.config().Output_dir)
+	return out != "." && inDir(rel, out)
+}
+
+// add watches dir and every directory under it
+func (w *devWatcher) add(dir string) {
+	filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		if w.ignored(path) {
+			return filepath.SkipDir
+		}
+		if err := w.watcher.Add(path); err != nil {
+			log.Println("[Klarity] Watcher error:", err)
+		}
+		return nil
+	})
+}
+
+// rescanLater watches the whole project again once renames settle, fsnotify drops the watch of a moved
+// directory when it's told about the move, which can be after its new name was already watched
+func (w *devWatcher) rescanLater() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.rescan != nil {
+		w.rescan.Stop()
+	}
+	w.rescan = time.AfterFunc(200*time.Millisecond, func() { w.add(w.root) })
+}
+
+// relevant reports if a change to path can change the built site
+func (w *devWatcher) relevant(path string) bool {
+	rel, err := filepath.Rel(w.root, path)
+	if err != nil || !filepath.IsLocal(rel) {
+		return false
+	}
+	base := filepath.Base(rel)
+	// editor swap and backup files
+	if strings.HasPrefix(base, ".") || strings.HasSuffix(base, "~") {
+		return false
+	}
+	if rel == "klarity.toml" || (filepath.Dir(rel) == "." && strings.HasPrefix(base, "favicon.")) {
+		return true
+	}
+
+	c := w.config()
+	for _, file := range []string{c.Visual.Style, c.Visual.CustomCSS} {
+		if file != "" && rel == filepath.Clean(file) {
+			return true
+		}
+	}
+	dirs := append(allDocDirs(c), c.Static_dirs...)
+	if c.Templates_dir != "" {
+		dirs = append(dirs, c.Templates_dir)
+	}
+	for _, v := range c.Versions.List {
+		if v.Dir != "" {
+			dirs = append(dirs, v.Dir)
+		}
+	}
+	for _, dir := range dirs {
+		if inDir(rel, filepath.Clean(dir)) {
+			return true
+		}
+	}
+	return false
+}
+
+// inDir reports if rel is dir or inside of it, both relative to the project root
+func inDir(rel, dir string) bool {
+	r, err := filepath.Rel(dir, rel)
+	return err == nil && (r == "." || filepath.IsLocal(r))
+}
+
+// run calls rebuild for every change that can change the built site until done is closed,
+// config is true when klarity.toml changed
+func (w *devWatcher) run(done <-chan struct{}, rebuild func(config bool)) {
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+
+			if event.Has(fsnotify.Rename) {
+				w.rescanLater()
+			}
+			// a directory created or renamed into the project, files can be written into it before it's watched
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() && !w.ignored(event.Name) {
+					w.add(event.Name)
+				}
+			}
+
+			if !w.relevant(event.Name) {
+				continue
+			}
+			switch {
+			case event.Has(fsnotify.Create):
+				fmt.Println("[Watcher] Detected new file:", event.Name)
+			case event.Has(fsnotify.Write):
+				fmt.Println("[Watcher] Detected modification:", event.Name)
+			case event.Has(fsnotify.Remove):
+				fmt.Println("[Watcher] Detected deletion:", event.Name)
+			case event.Has(fsnotify.Rename):
+				fmt.Println("[Watcher] Detected rename:", event.Name)
+			default:
+				continue
+			}
+			rebuild(event.Name == filepath.Join(w.root, "klarity.toml"))
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Println("[Klarity] Watcher error:", err)
+		case <-done:
+			return
+		}
+	}
+}
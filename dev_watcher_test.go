@@ -0,0 +1,53 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestDevWatcherRelevant(t *testing.T) {
+	root := filepath.FromSlash("/project")
+	c := Config{
+		Output_dir:    "public",
+		Doc_dirs:      []string{"docs"},
+		Static_dirs:   []string{"assets/img"},
+		Templates_dir: "tpl",
+		Locales:       []LocaleConfig{{Lang: "pl", Doc_dirs: []string{"i18n/pl"}}},
+	}
+	c.Visual.CustomCSS = "custom.css"
+	w := &devWatcher{root: root, cfg: c}
+
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{path: "klarity.toml", want: true},
+		{path: "favicon.svg", want: true},
+		{path: "custom.css", want: true},
+		{path: "docs/new/nested/page.md", want: true},
+		{path: "docs/renamed", want: true},
+		{path: "i18n/pl/page.md", want: true},
+		{path: "assets/img/logo.png", want: true},
+		{path: "tpl/footer.html", want: true},
+		{path: "docs/.page.md.swp", want: false},
+		{path: "docs/page.md~", want: false},
+		{path: "assets/other.png", want: false},
+		{path: "public/_klarity_raw/docs/page.md", want: false},
+		{path: "notes/favicon.svg", want: false},
+		{path: "../outside/docs/page.md", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := w.relevant(filepath.Join(root, filepath.FromSlash(tt.path))); got != tt.want {
+				t.Errorf("relevant(%s) = %v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+
+	for dir, want := range map[string]bool{"": false, ".klarity": true, ".git": true, "public": true, "public/docs": true, "docs": false} {
+		if got := w.ignored(filepath.Join(root, filepath.FromSlash(dir))); got != want {
+			t.Errorf("ignored(%q) = %v, want %v", dir, got, want)
+		}
+	}
+}
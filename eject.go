@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/kong"
+)
+
+// where klarity eject puts the templates and the stylesheet if klarity.toml doesn't say otherwise
+const defaultEjectDir = "theme"
+
+// ejectManifest remembers which version of each file was ejected, so an upgrade of klarity
+// can tell apart changes made by the user from changes to the built-in files.
+// It's kept next to the ejected templates so it ends up in version control with them
+type ejectManifest struct {
+	Files map[string]ejectRecord `json:"files"` // by path relative to the project root
+}
+
+type ejectRecord struct {
+	Version string `json:"version"` // klarity version the file was ejected from
+	Hash    string `json:"hash"`    // hash of the built-in file when it was ejected
+}
+
+const ejectManifestName = ".klarity-eject.json"
+
+type ejectedFile struct {
+	embedded string // path in the embedded FS
+	dest     string // absolute destination
+	rel      string // destination relative to the project root
+}
+
+func (c *EjectCmd) Run(ctx *kong.Context) error {
+	root, err := filepath.Abs(c.Path)
+	if err != nil {
+		return err
+	}
+	cfg := ReadConfig(root)
+
+	templatesDir := cfg.Templates_dir
+	if templatesDir == "" {
+		templatesDir = defaultEjectDir
+	}
+	style := cfg.Visual.Style
+	if style == "" {
+		style = path.Join(templatesDir, "style.css")
+	}
+
+	files, err := ejectFiles(root, templatesDir, style)
+	if err != nil {
+		return err
+	}
+
+	manifestPath := filepath.Join(root, templatesDir, ejectManifestName)
+	manifest := loadEjectManifest(manifestPath)
+
+	for _, f := range files {
+		builtin, err := fs.ReadFile(ejectFS(f.embedded), f.embedded)
+		if err != nil {
+			return err
+		}
+		sum := hashBytes(builtin)
+
+		current, err := os.ReadFile(f.dest)
+		switch {
+		case os.IsNotExist(err):
+			fmt.Printf("created %s\n", f.rel)
+		case err != nil:
+			return err
+		case c.Force:
+			if !bytes.Equal(current, builtin) {
+				fmt.Printf("overwrote %s\n", f.rel)
+			}
+		default:
+			if status := ejectStatus(manifest, f.rel, sum, current, builtin); status != "" {
+				fmt.Printf("%s %s\n", f.rel, status)
+			}
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(f.dest), os.ModePerm); err != nil {
+			return err
+		}
+		if err := os.WriteFile(f.dest, builtin, 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", f.rel, err)
+		}
+		manifest.Files[f.rel] = ejectRecord{Version: appVersion, Hash: sum}
+	}
+
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(manifestPath, b, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", manifestPath, err)
+	}
+
+	configPath := filepath.Join(root, "klarity.toml")
+	if cfg.Templates_dir == "" {
+		if err := setConfigValue(configPath, "", "templates_dir", templatesDir); err != nil {
+			return err
+		}
+		fmt.Printf("set templates_dir = %q in klarity.toml\n", templatesDir)
+	}
+	if cfg.Visual.Style == "" {
+		if err := setConfigValue(configPath, "visual", "style", style); err != nil {
+			return err
+		}
+		fmt.Printf("set visual.style = %q in klarity.toml\n", style)
+	}
+
+	return nil
+}
+
+// ejectFiles lists every embedded template and the unminified stylesheet with where they get ejected to
+func ejectFiles(root, templatesDir, style string) ([]ejectedFile, error) {
+	var files []ejectedFile
+	err := fs.WalkDir(templates, "templates", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel := path.Join(filepath.ToSlash(templatesDir), path.Base(p))
+		files = append(files, ejectedFile{embedded: p, dest: filepath.Join(root, filepath.FromSlash(rel)), rel: rel})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rel := filepath.ToSlash(style)
+	files = append(files, ejectedFile{embedded: "assets/style.css", dest: filepath.Join(root, filepath.FromSlash(rel)), rel: rel})
+	return files, nil
+}
+
+// outdatedEjected lists the ejected files whose built-in version changed since they were ejected
+func outdatedEjected(root string, cfg Config) ([]string, error) {
+	if cfg.Templates_dir == "" {
+		return nil, nil
+	}
+	manifest := loadEjectManifest(filepath.Join(root, cfg.Templates_dir, ejectManifestName))
+	if len(manifest.Files) == 0 {
+		return nil, nil
+	}
+
+	style := cfg.Visual.Style
+	if style == "" {
+		style = path.Join(cfg.Templates_dir, "style.css")
+	}
+	files, err := ejectFiles(root, cfg.Templates_dir, style)
+	if err != nil {
+		return nil, err
+	}
+
+	var outdated []string
+	for _, f := range files {
+		record, ok := manifest.Files[f.rel]
+		if !ok {
+			continue
+		}
+		builtin, err := fs.ReadFile(ejectFS(f.embedded), f.embedded)
+		if err != nil {
+			return nil, err
+		}
+		if hashBytes(builtin) != record.Hash {
+			outdated = append(outdated, f.rel)
+		}
+	}
+	return outdated, nil
+}
+
+func ejectFS(name string) fs.FS {
+	if strings.HasPrefix(name, "assets/") {
+		return assets
+	}
+	return templates
+}
+
+func loadEjectManifest(path string) *ejectManifest {
+	m := &ejectManifest{Files: make(map[string]ejectRecord)}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return m
+	}
+	if err := json.Unmarshal(b, m); err != nil || m.Files == nil {
+		return &ejectManifest{Files: make(map[string]ejectRecord)}
+	}
+	return m
+}
+
+// ejectStatus explains how an already ejected file relates to the built-in one, or returns ""
+// if there is nothing to report
+func ejectStatus(m *ejectManifest, rel, builtinSum string, current, builtin []byte) string {
+	if bytes.Equal(current, builtin) {
+		return ""
+	}
+
+	added, removed := diffStat(string(current), string(builtin))
+	ejected, known := m.Files[rel]
+	switch {
+	case !known:
+		return fmt.Sprintf("differs from the built-in version (+%d -%d lines), use --force to overwrite it", added, removed)
+	case ejected.Hash == builtinSum:
+		return "was modified, keeping it"
+	case hashBytes(current) == ejected.Hash:
+		return fmt.Sprintf("is outdated, the built-in version changed since %s (+%d -%d lines), use --force to update it", ejected.Version, added, removed)
+	default:
+		return fmt.Sprintf("was modified and the built-in version changed since %s (+%d -%d lines), merge the changes by hand or use --force to overwrite it", ejected.Version, added, removed)
+	}
+}
+
+// diffStat counts the lines that have to be added and removed to turn a into b
+func diffStat(a, b string) (added, removed int) {
+	al, bl := strings.Split(a, "\n"), strings.Split(b, "\n")
+
+	// longest common subsequence of lines, one row at a time
+	prev := make([]int, len(bl)+1)
+	cur := make([]int, len(bl)+1)
+	for i := range al {
+		for j := range bl {
+			if al[i] == bl[j] {
+				cur[j+1] = prev[j] + 1
+			} else {
+				cur[j+1] = max(cur[j], prev[j+1])
+			}
+		}
+		prev, cur = cur, prev
+	}
+	common := prev[len(bl)]
+	return len(bl) - common, len(al) - common
+}
+
+var tomlTable = regexp.MustCompile(`^\s*\[\[?\s*([^\]]+?)\s*\]\]?\s*(#.*)?$`)
+
+// setConfigValue sets a string value in klarity.toml in place, so comments and formatting survive,
+// an empty section is the top level of the file
+func setConfigValue(path, section, key, value string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(strings.TrimRight(string(b), "\n"), "\n")
+	line := fmt.Sprintf("%s = %s", key, strconv.Quote(value))
+	keyRe := regexp.MustCompile(`^\s*` + regexp.QuoteMeta(key) + `\s*=`)
+
+	current := ""
+	insertAt := -1 // last line of the section, the value goes after it
+	for i, l := range lines {
+		if m := tomlTable.FindStringSubmatch(l); m != nil {
+			current = m[1]
+			if current == section {
+				insertAt = i
+			}
+			continue
+		}
+		if current != section {
+			continue
+		}
+		if keyRe.MatchString(l) {
+			lines[i] = line
+			return os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+		}
+		if strings.TrimSpace(l) != "" {
+			insertAt = i
+		}
+	}
+
+	switch {
+	case section == "" || insertAt >= 0:
+		lines = append(lines[:insertAt+1], append([]string{line}, lines[insertAt+1:]...)...)
+	default:
+		lines = append(lines, "", "["+section+"]", line)
+	}
+	return os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
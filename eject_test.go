@@ -0,0 +1,121 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSetConfigValue(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		section string
+		key     string
+		want    string
+	}{
+		{
+			name:    "top level",
+			content: "# site\ntitle = \"x\"\n\n[visual]\ntheme = \"a\"\n",
+			key:     "templates_dir",
+			want:    "# site\ntitle = \"x\"\ntemplates_dir = \"theme\"\n\n[visual]\ntheme = \"a\"\n",
+		},
+		{
+			name:    "existing section",
+			content: "title = \"x\"\n\n[visual]\ntheme = \"a\" # comment\n\n[visual.vars]\nbg_main = \"#000\"\n",
+			section: "visual",
+			key:     "style",
+			want:    "title = \"x\"\n\n[visual]\ntheme = \"a\" # comment\nstyle = \"theme\"\n\n[visual.vars]\nbg_main = \"#000\"\n",
+		},
+		{
+			name:    "missing section",
+			content: "title = \"x\"\n",
+			section: "visual",
+			key:     "style",
+			want:    "title = \"x\"\n\n[visual]\nstyle = \"theme\"\n",
+		},
+		{
+			name:    "replace value",
+			content: "[visual]\nstyle = \"old.css\"\n",
+			section: "visual",
+			key:     "style",
+			want:    "[visual]\nstyle = \"theme\"\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := createTempDir(t)
+			defer os.RemoveAll(root)
+			path := filepath.Join(root, "klarity.toml")
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := setConfigValue(path, tt.section, tt.key, "theme"); err != nil {
+				t.Fatalf("setConfigValue() failed: %v", err)
+			}
+			got, _ := os.ReadFile(path)
+			if string(got) != tt.want {
+				t.Errorf("setConfigValue() wrote\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEject(t *testing.T) {
+	root := createTempDir(t)
+	defer os.RemoveAll(root)
+	writeTestDocs(t, root, map[string]string{
+		"klarity.toml": "title = \"x\"\noutput_dir = \"public\"\ndoc_dirs = [\"docs\"]\n",
+	})
+
+	if err := (&EjectCmd{Path: root}).Run(nil); err != nil {
+		t.Fatalf("eject failed: %v", err)
+	}
+
+	cfg := ReadConfig(root)
+	if cfg.Templates_dir != "theme" || cfg.Visual.Style != "theme/style.css" {
+		t.Fatalf("eject didn't wire the paths into klarity.toml: %+v", cfg)
+	}
+	layout := filepath.Join(root, "theme", "layout.html")
+	if _, err := os.Stat(layout); err != nil {
+		t.Fatalf("layout.html was not ejected: %v", err)
+	}
+	if _, err := loadTemplates(root, cfg); err != nil {
+		t.Errorf("ejected templates don't load: %v", err)
+	}
+
+	// pretend the file was ejected from an older klarity
+	m := loadEjectManifest(filepath.Join(root, "theme", ejectManifestName))
+	m.Files["theme/layout.html"] = ejectRecord{Version: "v0.0.0-old", Hash: hashBytes([]byte("old"))}
+	if err := os.WriteFile(layout, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	builtin, _ := templates.ReadFile("templates/layout.html")
+	status := ejectStatus(m, "theme/layout.html", hashBytes(builtin), []byte("old"), builtin)
+	if !strings.Contains(status, "is outdated") || !strings.Contains(status, "v0.0.0-old") {
+		t.Errorf("ejectStatus() = %q, want an outdated file", status)
+	}
+
+	if err := (&EjectCmd{Path: root}).Run(nil); err != nil {
+		t.Fatalf("second eject failed: %v", err)
+	}
+	if b, _ := os.ReadFile(layout); string(b) != "old" {
+		t.Errorf("eject overwrote an existing file without --force")
+	}
+	if err := (&EjectCmd{Path: root, Force: true}).Run(nil); err != nil {
+		t.Fatalf("eject --force failed: %v", err)
+	}
+	if b, _ := os.ReadFile(layout); string(b) != string(builtin) {
+		t.Errorf("eject --force didn't restore the built-in layout.html")
+	}
+}
+
+func TestDiffStat(t *testing.T) {
+	added, removed := diffStat("a\nb\nc\nd", "a\nc\nd\ne\nf")
+	if added != 2 || removed != 1 {
+		t.Errorf("diffStat() = +%d -%d, want +2 -1", added, removed)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+	"go.abhg.dev/goldmark/wikilink"
+)
+
+// how deep ![[page]] embeds can nest before klarity gives up
+const maxTransclusionDepth = 8
+
+// wikilinkExtender replaces wikilink.Extender, plain wikilinks are still rendered by wikilink.Renderer
+// but ![[...]] embeds go through embedRenderer so they can render media and transclude other pages
+type wikilinkExtender struct{}
+
+func (wikilinkExtender) Extend(md goldmark.Markdown) {
+	// same priorities as wikilink.Extender, the link parser is at 200
+	md.Parser().AddOptions(
+		parser.WithInlineParsers(
+			util.Prioritized(&wikilink.Parser{}, 199),
+		),
+		parser.WithASTTransformers(
+			util.Prioritized(transclusionBlockTransformer{}, 0),
+		),
+	)
+	md.Renderer().AddOptions(
+		renderer.WithNodeRenderers(
+			util.Prioritized(&embedRenderer{
+				md:    md,
+				links: &wikilink.Renderer{Resolver: KlarityResolver{}},
+			}, 199),
+		),
+	)
+}
+
+// transclusionBlockTransformer unwraps ![[page]] embeds that sit alone in a paragraph,
+// so the embedded page isn't rendered inside of a <p>
+type transclusionBlockTransformer struct{}
+
+func (transclusionBlockTransformer) Transform(doc *ast.Document, _ text.Reader, _ parser.Context) {
+	var paragraphs []ast.Node
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering || n.Kind() != ast.KindParagraph || n.ChildCount() != 1 {
+			return ast.WalkContinue, nil
+		}
+		if wl, ok := n.FirstChild().(*wikilink.Node); ok && wl.Embed {
+			if ext := filepath.Ext(string(wl.Target)); ext == "" || ext == ".md" {
+				paragraphs = append(paragraphs, n)
+			}
+		}
+		return ast.WalkSkipChildren, nil
+	})
+
+	for _, p := range paragraphs {
+		p.Parent().ReplaceChild(p.Parent(), p, p.FirstChild())
+	}
+}
+
+type embedRenderer struct {
+	md    goldmark.Markdown // used to render transcluded pages
+	links *wikilink.Renderer
+}
+
+func (r *embedRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(wikilink.Kind, r.render)
+}
+
+func (r *embedRenderer) render(w util.BufWriter, src []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	n, ok := node.(*wikilink.Node)
+	if !ok {
+		return ast.WalkStop, fmt.Errorf("unexpected node %T, expected *wikilink.Node", node)
+	}
+
+	page := nodePageContext(n)
+	if !n.Embed || page == nil {
+		return r.links.Render(w, src, node, entering)
+	}
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+
+	if target := wikilinkTarget(page.source, string(n.Target)); target != "" {
+		return ast.WalkSkipChildren, r.transclude(w, page, target, string(n.Fragment))
+	}
+	r.embedAsset(w, src, page, n)
+	return ast.WalkSkipChildren, nil
+}
+
+func (r *embedRenderer) transclude(w util.BufWriter, page *pageContext, target, section string) error {
+	rel := relOrAbs(page.root, target)
+
+	if target == page.source || slices.Contains(page.parents, target) || len(page.parents) >= maxTransclusionDepth {
+		fmt.Fprintf(w, `<p class="transclusion-error">%s can't be embedded inside itself</p>`, html.EscapeString(rel))
+		return nil
+	}
+
+	page.deps[target] = true
+	src, err := os.ReadFile(target)
+	if err != nil {
+		fmt.Fprintf(w, `<p class="transclusion-error">%s does not exist</p>`, html.EscapeString(rel))
+		return nil
+	}
+
+	sub := &pageContext{
+		root:    page.root,
+		source:  target,
+		cfg:     page.cfg,
+		assets:  page.assets,
+		deps:    page.deps,
+		parents: append(slices.Clone(page.parents), page.source),
+	}
+	ctx := parser.NewContext()
+	ctx.Set(pageContextKey, sub)
+	doc := r.md.Parser().Parse(text.NewReader(src), parser.WithContext(ctx))
+
+	if section != "" {
+		doc = extractSection(doc, src, section)
+		if doc == nil {
+			fmt.Fprintf(w, `<p class="transclusion-error">%s has no section %s</p>`, html.EscapeString(rel), html.EscapeString(section))
+			return nil
+		}
+	}
+
+	fmt.Fprintf(w, `<div class="transclusion" data-source="%s">`+"\n", html.EscapeString(rel))
+	if err := r.md.Renderer().Render(w, src, doc); err != nil {
+		return fmt.Errorf("failed to embed %s: %w", rel, err)
+	}
+	w.WriteString("</div>\n")
+	return nil
+}
+
+// extractSection returns a document with only the heading matching section (by id or text)
+// and everything under it, or nil if there's no such heading
+func extractSection(doc ast.Node, src []byte, section string) ast.Node {
+	var start *ast.Heading
+	for c := doc.FirstChild(); c != nil; c = c.NextSibling() {
+		h, ok := c.(*ast.Heading)
+		if ok && headingMatches(h, src, section) {
+			start = h
+			break
+		}
+	}
+	if start == nil {
+		return nil
+	}
+
+	out := ast.NewDocument()
+	for c := ast.Node(start); c != nil; {
+		next := c.NextSibling()
+		if h, ok := c.(*ast.Heading); ok && c != start && h.Level <= start.Level {
+			break
+		}
+		out.AppendChild(out, c)
+		c = next
+	}
+	return out
+}
+
+func headingMatches(h *ast.Heading, src []byte, section string) bool {
+	if id, ok := h.AttributeString("id"); ok {
+		if b, ok := id.([]byte); ok && string(b) == section {
+			return true
+		}
+	}
+	return strings.EqualFold(strings.TrimSpace(string(nodeText(h, src))), strings.TrimSpace(section))
+}
+
+func nodeText(n ast.Node, src []byte) []byte {
+	var buf bytes.Buffer
+	ast.Walk(n, func(c ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch c := c.(type) {
+		case *ast.Text:
+			buf.Write(c.Segment.Value(src))
+		case *ast.String:
+			buf.Write(c.Value)
+		}
+		return ast.WalkContinue, nil
+	})
+	return buf.Bytes()
+}
+
+// ![[image.png|300]] and ![[image.png|300x200]] set the size instead of the alt text, like in obsidian
+var embedSize = regexp.MustCompile(`^(\d+)(?:x(\d+))?$`)
+
+func (r *embedRenderer) embedAsset(w util.BufWriter, src []byte, page *pageContext, n *wikilink.Node) {
+	target := filepath.Clean(filepath.Join(filepath.Dir(page.source), string(n.Target)))
+	dest, ok := page.assetURL(target)
+	if !ok {
+		w.Write(util.EscapeHTML([]byte("![[" + string(n.Target) + "]]")))
+		return
+	}
+	url := html.EscapeString(string(util.URLEscape([]byte(dest), true)))
+
+	var label string
+	if n.ChildCount() > 0 {
+		if l := string(nodeText(n, src)); l != string(n.Target) {
+			label = l
+		}
+	}
+
+	var size string
+	if m := embedSize.FindStringSubmatch(label); m != nil {
+		size = fmt.Sprintf(` width="%s"`, m[1])
+		if m[2] != "" {
+			size += fmt.Sprintf(` height="%s"`, m[2])
+		}
+		label = ""
+	}
+	alt := html.EscapeString(label)
+
+	switch mediaKind(target) {
+	case "image":
+		fmt.Fprintf(w, `<img src="%s" alt="%s"%s>`, url, alt, size)
+	case "video":
+		fmt.Fprintf(w, `<video class="embed" src="%s" controls%s></video>`, url, size)
+	case "audio":
+		fmt.Fprintf(w, `<audio class="embed" src="%s" controls></audio>`, url)
+	case "pdf":
+		fmt.Fprintf(w, `<iframe class="embed embed-pdf" src="%s"%s></iframe>`, url, size)
+	default:
+		if alt == "" {
+			alt = html.EscapeString(filepath.Base(target))
+		}
+		fmt.Fprintf(w, `<a href="%s">%s</a>`, url, alt)
+	}
+}
+
+func mediaKind(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".apng", ".avif", ".gif", ".jpg", ".jpeg", ".jfif", ".pjpeg", ".pjp", ".png", ".svg", ".webp", ".bmp", ".ico":
+		return "image"
+	case ".mp4", ".webm", ".ogv", ".mov", ".mkv", ".m4v":
+		return "video"
+	case ".mp3", ".wav", ".ogg", ".oga", ".m4a", ".flac", ".opus", ".aac":
+		return "audio"
+	case ".pdf":
+		return "pdf"
+	default:
+		return ""
+	}
+}
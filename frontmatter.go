@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/yuin/goldmark/parser"
+	"go.abhg.dev/goldmark/frontmatter"
+)
+
+// FrontMatter is the optional YAML (---) or TOML (+++) block at the top of a page
+type FrontMatter struct {
+	Title       string   `yaml:"title" toml:"title"`
+	Description string   `yaml:"description" toml:"description"`
+	Weight      int      `yaml:"weight" toml:"weight"`
+	Draft       bool     `yaml:"draft" toml:"draft"`
+	Tags        []string `yaml:"tags" toml:"tags"`
+}
+
+func readFrontMatter(ctx parser.Context) (FrontMatter, error) {
+	var fm FrontMatter
+	data := frontmatter.Get(ctx)
+	if data == nil {
+		return fm, nil
+	}
+	if err := data.Decode(&fm); err != nil {
+		return fm, fmt.Errorf("invalid front matter: %w", err)
+	}
+	return fm, nil
+}
+
+// drafts are only rendered by the dev server
+func isPublished(fm FrontMatter) bool {
+	return !fm.Draft || dev_server
+}
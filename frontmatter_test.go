@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/parser"
+	"go.abhg.dev/goldmark/frontmatter"
+)
+
+func TestReadFrontMatter(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		want    FrontMatter
+		wantErr bool
+	}{
+		{
+			name: "yaml",
+			src:  "---\ntitle: Guide\nweight: 2\ntags: [setup, cli]\ndraft: true\n---\n# Body",
+			want: FrontMatter{Title: "Guide", Weight: 2, Tags: []string{"setup", "cli"}, Draft: true},
+		},
+		{
+			name: "toml",
+			src:  "+++\ntitle = \"Guide\"\nweight = -1\ntags = [\"setup\"]\n+++\n# Body",
+			want: FrontMatter{Title: "Guide", Weight: -1, Tags: []string{"setup"}},
+		},
+		{
+			name: "none",
+			src:  "# Body\n\n---\ntitle: not front matter\n",
+		},
+		{
+			name:    "malformed",
+			src:     "---\ntitle: [unclosed\n---\n# Body",
+			wantErr: true,
+		},
+	}
+
+	md := goldmark.New(goldmark.WithExtensions(&frontmatter.Extender{}))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := parser.NewContext()
+			var buf bytes.Buffer
+			if err := md.Convert([]byte(tt.src), &buf, parser.WithContext(ctx)); err != nil {
+				t.Fatalf("Convert() error = %v", err)
+			}
+			got, err := readFrontMatter(ctx)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readFrontMatter() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readFrontMatter() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsPublished(t *testing.T) {
+	tests := []struct {
+		name string
+		fm   FrontMatter
+		dev  bool
+		want bool
+	}{
+		{name: "page", want: true},
+		{name: "draft", fm: FrontMatter{Draft: true}, want: false},
+		{name: "draft in the dev server", fm: FrontMatter{Draft: true}, dev: true, want: true},
+		{name: "page in the dev server", dev: true, want: true},
+	}
+
+	defer func(dev bool) { dev_server = dev }(dev_server)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dev_server = tt.dev
+			if got := isPublished(tt.fm); got != tt.want {
+				t.Errorf("isPublished() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/text"
+	"go.abhg.dev/goldmark/wikilink"
+)
+
+type linkIssue struct {
+	File    string // relative to the project root
+	Line    int
+	Link    string
+	Problem string
+}
+
+func (i linkIssue) Pos() string {
+	return fmt.Sprintf("%s:%d", filepath.ToSlash(i.File), i.Line)
+}
+
+func (i linkIssue) String() string {
+	return fmt.Sprintf("%s: %s: %s", i.Pos(), i.Link, i.Problem)
+}
+
+// pageLink is a link found in a page before it is checked
+type pageLink struct {
+	raw      string // how the link is shown to the user
+	target   string // absolute path of the linked file, equal to the source for same page links
+	fragment string
+	page     bool // target is a markdown page whose headings can be checked
+	offset   int
+}
+
+type parsedPage struct {
+	src      []byte
+	ids      map[string]bool
+	headings map[string]bool // lowercase heading text, obsidian style [[page#Heading]] links use it
+	links    []pageLink
+}
+
+// checkLinks parses every doc and reports wikilinks and relative markdown links to files that don't exist,
+// and #fragments that don't match a heading ID in the linked page
+func checkLinks(root string, c Config, docs []string) ([]linkIssue, error) {
+	md := newMarkdown(c)
+
+	pages := make(map[string]*parsedPage, len(docs))
+	for _, doc := range docs {
+		p, err := parseLinks(md, doc)
+		if err != nil {
+			return nil, err
+		}
+		pages[filepath.Clean(doc)] = p
+	}
+
+	var issues []linkIssue
+	for _, doc := range docs {
+		p := pages[filepath.Clean(doc)]
+		rel, _ := filepath.Rel(root, doc)
+
+		for _, l := range p.links {
+			issue := linkIssue{
+				File: rel,
+				Line: bytes.Count(p.src[:l.offset], []byte("\n")) + 1,
+				Link: l.raw,
+			}
+
+			if !l.page {
+				if _, err := os.Stat(l.target); err != nil {
+					issue.Problem = fmt.Sprintf("%s does not exist", relOrAbs(root, l.target))
+					issues = append(issues, issue)
+				} else if !isStaticFile(c, root, l.target) {
+					issue.Problem = fmt.Sprintf("%s is not in doc_dirs or static_dirs, so it is not published", relOrAbs(root, l.target))
+					issues = append(issues, issue)
+				}
+				continue
+			}
+
+			target, ok := pages[l.target]
+			if !ok {
+				issue.Problem = fmt.Sprintf("%s is not a page in doc_dirs", relOrAbs(root, l.target))
+				issues = append(issues, issue)
+				continue
+			}
+
+			if l.fragment != "" && !target.ids[l.fragment] && !target.headings[strings.ToLower(l.fragment)] {
+				issue.Problem = fmt.Sprintf("no heading with id #%s in %s", l.fragment, relOrAbs(root, l.target))
+				issues = append(issues, issue)
+			}
+		}
+	}
+
+	return issues, nil
+}
+
+func parseLinks(md goldmark.Markdown, doc string) (*parsedPage, error) {
+	src, err := os.ReadFile(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	// parsed without a pageContext so links keep the destination written in the doc
+	node := md.Parser().Parse(text.NewReader(src))
+
+	p := &parsedPage{src: src, ids: make(map[string]bool), headings: make(map[string]bool)}
+	source := filepath.Clean(doc)
+
+	err = ast.Walk(node, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+
+		switch n := n.(type) {
+		case *ast.Heading:
+			if id, ok := n.AttributeString("id"); ok {
+				if b, ok := id.([]byte); ok {
+					p.ids[string(b)] = true
+				}
+			}
+			p.headings[strings.ToLower(strings.TrimSpace(string(nodeText(n, src))))] = true
+		case *wikilink.Node:
+			target := wikilinkTarget(source, string(n.Target))
+			raw := "[[" + string(n.Target)
+			if len(n.Fragment) > 0 {
+				raw += "#" + string(n.Fragment)
+			}
+			raw += "]]"
+			if n.Embed {
+				raw = "!" + raw
+			}
+
+			l := pageLink{raw: raw, target: target, fragment: string(n.Fragment), page: true, offset: nodeOffset(n)}
+			if target == "" {
+				// embeds and links to anything that isn't a page
+				l.target = filepath.Join(filepath.Dir(source), string(n.Target))
+				l.page = false
+			}
+			p.links = append(p.links, l)
+		case *ast.Link:
+			if l, ok := relativeLink(source, string(n.Destination)); ok {
+				l.offset = nodeOffset(n)
+				p.links = append(p.links, l)
+			}
+		case *ast.Image:
+			if l, ok := relativeLink(source, string(n.Destination)); ok {
+				l.offset = nodeOffset(n)
+				p.links = append(p.links, l)
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// relativeLink resolves a plain markdown link destination, links with a scheme or
+// an absolute path are left to the browser and not checked
+func relativeLink(source, dest string) (pageLink, bool) {
+	target, u, ok := resolveRelative(source, dest)
+	if !ok {
+		return pageLink{}, false
+	}
+	return pageLink{
+		raw:      dest,
+		target:   target,
+		fragment: u.Fragment,
+		page:     target == source || filepath.Ext(target) == ".md",
+	}, true
+}
+
+// nodeOffset finds where an inline node starts in the source, falling back to the enclosing block
+func nodeOffset(n ast.Node) int {
+	var offset = -1
+	ast.Walk(n, func(c ast.Node, entering bool) (ast.WalkStatus, error) {
+		if t, ok := c.(*ast.Text); ok && entering {
+			offset = t.Segment.Start
+			return ast.WalkStop, nil
+		}
+		return ast.WalkContinue, nil
+	})
+	if offset >= 0 {
+		return offset
+	}
+
+	for b := n; b != nil; b = b.Parent() {
+		if b.Type() == ast.TypeBlock && b.Lines().Len() > 0 {
+			return b.Lines().At(0).Start
+		}
+	}
+	return 0
+}
+
+func relOrAbs(root, path string) string {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return path
+	}
+	return filepath.ToSlash(rel)
+}
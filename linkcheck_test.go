@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"testing"
+)
+
+func TestCheckLinks(t *testing.T) {
+	root := createTempDir(t)
+	defer os.RemoveAll(root)
+
+	paths := writeTestDocs(t, root, map[string]string{
+		"docs/main.md": "# Main\n\n## Setup\n\n[[guide]] [[guide#usage]] [[#setup]]\n\n[[missing]]\n[[guide#nope]]\n",
+		"docs/guide.md": "# Guide\n\n## Usage\n\n[back](./main.md#setup) [gone](../other/gone.md)\n\n" +
+			"![img](img/logo.png) [site](https://example.com) [top](#guide) [bad](#bad)\n\n[config](../klarity.toml)\n",
+		"docs/img/logo.png": "png",
+		"klarity.toml":      "title = \"Test\"",
+	})
+	var docs []string
+	for _, p := range paths {
+		if p[len(p)-3:] == ".md" {
+			docs = append(docs, p)
+		}
+	}
+
+	issues, err := checkLinks(root, Config{Base_URL: "/", Doc_dirs: []string{"docs"}}, docs)
+	if err != nil {
+		t.Fatalf("checkLinks() failed: %v", err)
+	}
+
+	var got []string
+	for _, issue := range issues {
+		got = append(got, issue.Pos()+" "+issue.Link)
+	}
+	sort.Strings(got)
+
+	want := []string{
+		"docs/guide.md:5 ../other/gone.md",
+		"docs/guide.md:7 #bad",
+		"docs/guide.md:9 ../klarity.toml",
+		"docs/main.md:7 [[missing]]",
+		"docs/main.md:8 [[guide#nope]]",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("checkLinks() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("checkLinks() issue %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
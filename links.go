@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+)
+
+// linkTransformer rewrites relative markdown links and images pointing at files in the project,
+// so they lead to the copy in the output no matter where the page ends up and respect base_url,
+// links to other .md docs lead to the built page the same way wikilinks do
+type linkTransformer struct{}
+
+func (linkTransformer) Transform(doc *ast.Document, _ text.Reader, pc parser.Context) {
+	page, ok := pc.Get(pageContextKey).(*pageContext)
+	if !ok {
+		return
+	}
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch n := n.(type) {
+		case *ast.Link:
+			n.Destination = page.rewriteLink(n.Destination)
+		case *ast.Image:
+			n.Destination = page.rewriteLink(n.Destination)
+		}
+		return ast.WalkContinue, nil
+	})
+}
+
+func (p *pageContext) rewriteLink(dest []byte) []byte {
+	target, u, ok := resolveRelative(p.source, string(dest))
+	if !ok || u.Path == "" {
+		// #fragment links already point at the right page
+		return dest
+	}
+
+	var out string
+	if filepath.Ext(target) == ".md" {
+		out, ok = p.pageURL(target)
+	} else {
+		out, ok = p.assetURL(target)
+	}
+	if !ok {
+		return dest
+	}
+	if u.RawQuery != "" {
+		out += "?" + u.RawQuery
+	}
+	if u.Fragment != "" {
+		out += "#" + u.EscapedFragment()
+	}
+	return []byte(out)
+}
+
+// resolveRelative resolves a link destination written in source to the file it points to,
+// links with a scheme or an absolute path are left to the browser, links with only a #fragment resolve to source
+func resolveRelative(source, dest string) (string, *url.URL, bool) {
+	u, err := url.Parse(dest)
+	if err != nil || u.Scheme != "" || u.Host != "" || strings.HasPrefix(u.Path, "/") {
+		return "", nil, false
+	}
+	if u.Path == "" {
+		if u.Fragment == "" {
+			return "", nil, false
+		}
+		return source, u, true
+	}
+	return filepath.Clean(filepath.Join(filepath.Dir(source), filepath.FromSlash(u.Path))), u, true
+}
+
+// isStaticFile reports if path is one of the files collectStaticFiles publishes, a file in doc_dirs
+// or static_dirs, so a link can't publish klarity.toml, hidden files or anything else in the project
+func isStaticFile(c Config, root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || !filepath.IsLocal(rel) || rel == "klarity.toml" || filepath.Base(rel) == "_nav.toml" {
+		return false
+	}
+	if out := filepath.Clean(c.Output_dir); out != "." && inDir(rel, out) {
+		return false
+	}
+	for _, dir := range slices.Concat(c.Doc_dirs, c.Static_dirs) {
+		dir = filepath.Clean(dir)
+		if !inDir(rel, dir) {
+			continue
+		}
+		inner, _ := filepath.Rel(dir, rel)
+		for _, part := range strings.Split(inner, string(filepath.Separator)) {
+			if strings.HasPrefix(part, ".") && part != "." {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// isPageSource reports if rel, relative to the project root, is a page the editor and klarity apply
+// may change, a markdown file in doc_dirs or the dir of a version
+func isPageSource(c Config, rel string) bool {
+	if !filepath.IsLocal(rel) || filepath.Ext(rel) != ".md" {
+		return false
+	}
+	dirs := allDocDirs(c)
+	for _, v := range c.Versions.List {
+		if v.Dir != "" {
+			dirs = append(dirs, v.Dir)
+		}
+	}
+	for _, dir := range dirs {
+		if inDir(rel, filepath.Clean(dir)) {
+			return true
+		}
+	}
+	return false
+}
+
+// collectStaticFiles returns every file that isn't markdown in doc_dirs and static_dirs,
+// hidden files, nav manifests, the output directory and the klarity cache are skipped
+func collectStaticFiles(c Config, root string) ([]string, error) {
+	outputDir := filepath.Clean(filepath.Join(root, c.Output_dir))
+	cache := filepath.Join(root, cacheDir)
+
+	var files []string
+	for _, dir := range slices.Concat(c.Doc_dirs, c.Static_dirs) {
+		full := filepath.Join(root, dir)
+		if _, err := os.Stat(full); os.IsNotExist(err) {
+			continue
+		}
+		err := filepath.Walk(full, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if path != full && strings.HasPrefix(info.Name(), ".") {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if info.IsDir() {
+				if path == outputDir || path == cache {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if filepath.Ext(path) == ".md" || info.Name() == "_nav.toml" || path == filepath.Join(root, "klarity.toml") {
+				return nil
+			}
+			files = append(files, path)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	slices.Sort(files)
+	return slices.Compact(files), nil
+}
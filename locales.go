@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// language of the pages when no [[locales]] are configured
+const defaultLang = "en"
+
+// LocaleLink is an entry in the language switcher and an hreflang alternate of a page
+type LocaleLink struct {
+	Lang       string
+	Label      string
+	URL        string // the same page in this locale, or its entry page if it wasn't translated
+	Current    bool
+	Translated bool // false if URL points at the entry page
+}
+
+// localeIndex lists the pages of a locale, so every locale can link to the translations of a page
+type localeIndex struct {
+	lang  string
+	label string
+	entry string            // URL of the entry page
+	pages map[string]string // URLs by localePageKey
+}
+
+type redirectData struct {
+	Default string            // URL of the first locale
+	URLs    map[string]string // entry URLs by lang, to pick one from the browser languages
+	Locales []LocaleLink
+}
+
+// buildLocalized builds every locale of s into output_dir/<lang>, with a page at the root of output_dir
+// that redirects to the language of the browser, without [[locales]] it's the same as buildSite
+func buildLocalized(s site, opts buildOptions) error {
+	c := s.cfg
+	if len(c.Locales) == 0 {
+		return buildSite(s, opts)
+	}
+	if err := validateLocales(c); err != nil {
+		return err
+	}
+
+	indexes := make([]*localeIndex, 0, len(c.Locales))
+	for _, l := range c.Locales {
+		idx, err := indexLocale(s.src, localeConfig(c, l), l)
+		if err != nil {
+			return fmt.Errorf("locale %s: %w", l.Lang, err)
+		}
+		indexes = append(indexes, idx)
+	}
+
+	for _, l := range c.Locales {
+		fmt.Printf("Building locale %s\n", l.Lang)
+		ls := s
+		ls.cfg = localeConfig(c, l)
+		ls.cache = strings.Trim(s.cache+"-"+l.Lang, "-")
+		ls.nested = nil
+		ls.lang = l.Lang
+		ls.locales = indexes
+		// stay in the same locale when switching versions
+		ls.versions = make([]VersionLink, len(s.versions))
+		for i, v := range s.versions {
+			v.URL = joinBaseURL(v.URL, l.Lang)
+			ls.versions[i] = v
+		}
+		if err := buildSite(ls, opts); err != nil {
+			return fmt.Errorf("locale %s: %w", l.Lang, err)
+		}
+	}
+
+	return writeLocaleRedirect(s, indexes)
+}
+
+// localeConfig is the config a locale is built with, served from output_dir/<lang>
+func localeConfig(c Config, l LocaleConfig) Config {
+	lc := c
+	lc.Title = cmp.Or(l.Title, c.Title)
+	lc.Doc_dirs = l.Doc_dirs
+	lc.Entry = l.Entry
+	lc.Base_URL = joinBaseURL(c.Base_URL, l.Lang)
+	lc.Output_dir = filepath.Join(c.Output_dir, l.Lang)
+	lc.pagesFromDocDirs = true
+	return lc
+}
+
+// allDocDirs lists doc_dirs and the doc dirs of every locale
+func allDocDirs(c Config) []string {
+	dirs := slices.Clone(c.Doc_dirs)
+	for _, l := range c.Locales {
+		dirs = append(dirs, l.Doc_dirs...)
+	}
+	return dirs
+}
+
+func validateLocales(c Config) error {
+	seen := make(map[string]bool)
+	for _, l := range c.Locales {
+		switch {
+		case l.Lang == "":
+			return errors.New("every entry in locales needs a lang")
+		case l.Lang == "." || l.Lang == ".." || strings.ContainsAny(l.Lang, `/\`):
+			return fmt.Errorf("locale %q can't be used as a directory name", l.Lang)
+		case slices.Contains(reservedOutput, l.Lang):
+			return fmt.Errorf("locale %q collides with the output of klarity", l.Lang)
+		case seen[l.Lang]:
+			return fmt.Errorf("locale %q is listed more than once", l.Lang)
+		case len(l.Doc_dirs) == 0:
+			return fmt.Errorf("locale %q has no doc_dirs", l.Lang)
+		case l.Entry == "":
+			return fmt.Errorf("locale %q has no entry", l.Lang)
+		}
+		seen[l.Lang] = true
+	}
+	return nil
+}
+
+func indexLocale(src string, c Config, l LocaleConfig) (*localeIndex, error) {
+	docs, err := collectMarkdownFiles(c, src)
+	if err != nil {
+		return nil, err
+	}
+
+	base := normalizeURL(c.Base_URL)
+	idx := &localeIndex{
+		lang:  l.Lang,
+		label: cmp.Or(l.Label, l.Lang),
+		entry: base + "/",
+		pages: make(map[string]string, len(docs)),
+	}
+	for _, doc := range docs {
+		url, ok := newPageContext(src, doc, c).pageURL(doc)
+		if !ok {
+			continue
+		}
+		key := localePageKey(src, c, doc)
+		if key == "" {
+			url = idx.entry
+		}
+		idx.pages[key] = url
+	}
+	return idx, nil
+}
+
+// localePageKey identifies a page across locales by its path in the doc dirs of its locale,
+// the entry pages of all locales share the empty key
+func localePageKey(src string, c Config, doc string) string {
+	if filepath.Clean(doc) == filepath.Clean(filepath.Join(src, c.Entry)) {
+		return ""
+	}
+	for _, dir := range c.Doc_dirs {
+		rel, err := filepath.Rel(filepath.Join(src, dir), doc)
+		if err == nil && filepath.IsLocal(rel) {
+			return strings.TrimSuffix(filepath.ToSlash(rel), ".md")
+		}
+	}
+	rel, _ := filepath.Rel(src, doc)
+	return strings.TrimSuffix(filepath.ToSlash(rel), ".md")
+}
+
+// localeLinks links the page with key to its translations, nil if the site has no locales
+func (s site) localeLinks(key string) []LocaleLink {
+	var links []LocaleLink
+	for _, l := range s.locales {
+		url, ok := l.pages[key]
+		if !ok {
+			url = l.entry
+		}
+		links = append(links, LocaleLink{Lang: l.lang, Label: l.label, URL: url, Current: l.lang == s.lang, Translated: ok})
+	}
+	return links
+}
+
+func writeLocaleRedirect(s site, indexes []*localeIndex) error {
+	tpls, err := loadTemplates(s.root, s.cfg)
+	if err != nil {
+		return err
+	}
+
+	data := redirectData{
+		Default: indexes[0].entry,
+		URLs:    make(map[string]string, len(indexes)),
+	}
+	for _, l := range indexes {
+		data.URLs[l.lang] = l.entry
+		data.Locales = append(data.Locales, LocaleLink{Lang: l.lang, Label: l.label, URL: l.entry, Translated: true})
+	}
+
+	var buf bytes.Buffer
+	if err := tpls.redirect.Execute(&buf, data); err != nil {
+		return fmt.Errorf("error rendering the locale redirect: %w", err)
+	}
+	outPath := filepath.Join(s.root, s.cfg.Output_dir, "index.html")
+	if err := os.MkdirAll(filepath.Dir(outPath), os.ModePerm); err != nil {
+		return err
+	}
+	return os.WriteFile(outPath, buf.Bytes(), 0644)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocaleLinks(t *testing.T) {
+	tempDir := createTempDir(t)
+	defer os.RemoveAll(tempDir)
+
+	writeTestDocs(t, tempDir, map[string]string{
+		"docs/en/main.md":         "# Home",
+		"docs/en/guide/intro.md":  "# Intro",
+		"docs/en/guide/extra.md":  "# Extra",
+		"docs/pl/start.md":        "# Start",
+		"docs/pl/guide/intro.md":  "# Wstęp",
+		"docs/pl/guide/_index.md": "---\ntitle: Przewodnik\n---",
+	})
+
+	c := Config{
+		Base_URL: "/",
+		Locales: []LocaleConfig{
+			{Lang: "en", Label: "English", Doc_dirs: []string{"docs/en"}, Entry: "docs/en/main.md"},
+			{Lang: "pl", Doc_dirs: []string{"docs/pl"}, Entry: "docs/pl/start.md"},
+		},
+	}
+	if err := validateLocales(c); err != nil {
+		t.Fatalf("validateLocales() error = %v", err)
+	}
+
+	s := site{src: tempDir, lang: "pl"}
+	for _, l := range c.Locales {
+		idx, err := indexLocale(tempDir, localeConfig(c, l), l)
+		if err != nil {
+			t.Fatalf("indexLocale(%s) error = %v", l.Lang, err)
+		}
+		s.locales = append(s.locales, idx)
+	}
+	pl := localeConfig(c, c.Locales[1])
+
+	tests := []struct {
+		name string
+		page string
+		want []LocaleLink
+	}{
+		{
+			name: "entry pages are translations of each other",
+			page: "docs/pl/start.md",
+			want: []LocaleLink{
+				{Lang: "en", Label: "English", URL: "/en/", Translated: true},
+				{Lang: "pl", Label: "pl", URL: "/pl/", Current: true, Translated: true},
+			},
+		},
+		{
+			name: "same path in the doc dir",
+			page: "docs/pl/guide/intro.md",
+			want: []LocaleLink{
+				{Lang: "en", Label: "English", URL: "/en/guide/intro.html", Translated: true},
+				{Lang: "pl", Label: "pl", URL: "/pl/guide/intro.html", Current: true, Translated: true},
+			},
+		},
+		{
+			name: "untranslated page falls back to the entry",
+			page: "docs/pl/guide/missing.md",
+			want: []LocaleLink{
+				{Lang: "en", Label: "English", URL: "/en/"},
+				{Lang: "pl", Label: "pl", URL: "/pl/", Current: true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := s.localeLinks(localePageKey(tempDir, pl, filepath.Join(tempDir, tt.page)))
+			if len(got) != len(tt.want) {
+				t.Fatalf("localeLinks() = %+v, want %+v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("localeLinks()[%d] = %+v, want %+v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestBuildLocalized(t *testing.T) {
+	root := createTempDir(t)
+	defer os.RemoveAll(root)
+
+	writeTestDocs(t, root, map[string]string{
+		"docs/en/main.md":        "# Home",
+		"docs/en/guide/intro.md": "# Intro",
+		"docs/pl/start.md":       "# Start",
+		"docs/pl/guide/intro.md": "# Wstęp",
+	})
+	c := Config{
+		Title:      "Test",
+		Output_dir: "out",
+		Base_URL:   "/",
+		Locales: []LocaleConfig{
+			{Lang: "en", Doc_dirs: []string{"docs/en"}, Entry: "docs/en/main.md"},
+			{Lang: "pl", Doc_dirs: []string{"docs/pl"}, Entry: "docs/pl/start.md"},
+		},
+	}
+	c.Build.Search = "none"
+	if err := buildLocalized(site{root: root, src: root, cfg: c}, buildOptions{}); err != nil {
+		t.Fatalf("buildLocalized() error = %v", err)
+	}
+
+	// pages are placed relative to the doc dir of their locale
+	for _, rel := range []string{"index.html", "en/index.html", "en/guide/intro.html", "pl/index.html", "pl/guide/intro.html"} {
+		if _, err := os.Stat(filepath.Join(root, "out", rel)); err != nil {
+			t.Errorf("%s wasn't built: %v", rel, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "out", "en", "docs")); err == nil {
+		t.Error("out/en/docs exists, want pages outside of their doc dir path")
+	}
+	page, _ := os.ReadFile(filepath.Join(root, "out", "pl", "guide", "intro.html"))
+	if !strings.Contains(string(page), `hreflang="en" href="/en/guide/intro.html"`) {
+		t.Errorf("pl/guide/intro.html doesn't link to the English page at /en/guide/intro.html")
+	}
+}
+
+func TestValidateLocales(t *testing.T) {
+	tests := []struct {
+		name    string
+		locales []LocaleConfig
+		wantErr bool
+	}{
+		{
+			name:    "valid",
+			locales: []LocaleConfig{{Lang: "en", Doc_dirs: []string{"docs/en"}, Entry: "docs/en/main.md"}},
+		},
+		{
+			name:    "missing lang",
+			locales: []LocaleConfig{{Doc_dirs: []string{"docs/en"}, Entry: "docs/en/main.md"}},
+			wantErr: true,
+		},
+		{
+			name: "duplicate lang",
+			locales: []LocaleConfig{
+				{Lang: "en", Doc_dirs: []string{"docs/en"}, Entry: "docs/en/main.md"},
+				{Lang: "en", Doc_dirs: []string{"docs/en2"}, Entry: "docs/en2/main.md"},
+			},
+			wantErr: true,
+		},
+		{
+			name:    "lang shadowing the search index",
+			locales: []LocaleConfig{{Lang: "pagefind", Doc_dirs: []string{"docs"}, Entry: "docs/main.md"}},
+			wantErr: true,
+		},
+		{
+			name:    "missing entry",
+			locales: []LocaleConfig{{Lang: "en", Doc_dirs: []string{"docs/en"}}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateLocales(Config{Locales: tt.locales})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateLocales() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -2,20 +2,19 @@ package main
 
 import (
 	"bytes"
+	"cmp"
 	"embed"
-	"errors"
+	"encoding/json"
 	"fmt"
 	"html/template"
-	"io"
 	"log"
 	"log/slog"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/alecthomas/kong"
-	"github.com/bluekeyes/go-gitdiff/gitdiff"
 )
 
 //go:generate postcss --use autoprefixer postcss-pxtorem cssnano --no-map -o assets/style.min.css assets/style.css
@@ -28,8 +27,6 @@ var assets embed.FS
 
 const appVersion = "v0.0.0"
 
-var pwd string
-
 var CLI struct {
 	Init   InitCmd   `cmd:"" help:"Initialize a new Klarity project for writing docs."`
 	Build  BuildCmd  `cmd:"" help:"Build Klarity docs from a directory."`
@@ -37,6 +34,7 @@ var CLI struct {
 	Clean  CleanCmd  `cmd:"" help:"Cleans out all output files from a klarity project"`
 	Doctor DoctorCmd `cmd:"" help:"Diagnoses potential issues in a klarity project"`
 	Apply  ApplyCmd  `cmd:"" help:"Apply a Git patch to the Klarity project."`
+	Eject  EjectCmd  `cmd:"" help:"Copy the built-in templates and CSS into the project for customization."`
 	VersionCmd
 }
 
@@ -49,11 +47,21 @@ type InitCmd struct {
 }
 
 type BuildCmd struct {
-	Path string `arg:"" name:"path" help:"The directory containing the Klarity project to build" type:"path"`
+	Path    string `arg:"" name:"path" help:"The directory containing the Klarity project to build" type:"path"`
+	Force   bool   `name:"force" short:"f" help:"Ignore the build cache and rebuild every page."`
+	Workers int    `name:"workers" short:"j" help:"Number of pages rendered in parallel, overrides build.workers (default: number of CPUs)."`
+	Strict  bool   `name:"strict" help:"Fail the build if any page contains broken links or anchors."`
 }
 
 type DevServer struct {
-	Path string `arg:"" name:"path" help:"The directory containing the Klarity project" type:"path"`
+	Path     string `arg:"" name:"path" help:"The directory containing the Klarity project" type:"path"`
+	NoSearch bool   `name:"no-search" help:"Don't build the search index."`
+	Host     string `name:"host" help:"Address to listen on, 0.0.0.0 makes the server reachable from other devices. Overrides [dev] host."`
+	Port     int    `name:"port" help:"Port to listen on, the next free one is used if it's taken. Overrides [dev] port."`
+	TLS      bool   `name:"tls" help:"Serve over https with a self-signed certificate, unless --tls-cert and --tls-key are given."`
+	TLSCert  string `name:"tls-cert" type:"path" help:"Certificate file for https."`
+	TLSKey   string `name:"tls-key" type:"path" help:"Key file for https."`
+	Open     bool   `name:"open" help:"Open the site in the browser once the server is running."`
 }
 
 type CleanCmd struct {
@@ -64,206 +72,104 @@ type DoctorCmd struct {
 	Path string `arg:"" name:"paht" help:"The directory containing the Klarity project"`
 }
 
-type ApplyCmd struct {
+type EjectCmd struct {
 	Path  string `arg:"" name:"path" help:"The directory containing the Klarity project" type:"path"`
-	Patch string `arg:"" name:"patch" help:"The path to the patch file to apply" type:"path"`
-	Yes   bool   `name:"yes" short:"y" help:"Apply the patch without previewing or confirming."`
+	Force bool   `name:"force" short:"f" help:"Overwrite files that were already ejected with the built-in versions."`
 }
 
-func applyPatch(projectPath string, files []*gitdiff.File, dry bool) error {
-	for _, f := range files {
-		oldPath := ""
-		if f.OldName != "" {
-			oldPath = filepath.Join(projectPath, f.OldName)
-		}
-
-		newPath := ""
-		if f.NewName != "" {
-			newPath = filepath.Join(projectPath, f.NewName)
-		}
-
-		if f.IsDelete {
-			if oldPath == "" {
-				return errors.New("invalid delete patch for file")
-			}
-			if _, err := os.Stat(oldPath); os.IsNotExist(err) {
-				return fmt.Errorf("file to delete does not exist: %s", oldPath)
-			}
-			if !dry {
-				if err := os.Remove(oldPath); err != nil {
-					return fmt.Errorf("failed to delete %s: %w", oldPath, err)
-				}
-			}
-			continue
-		}
-
-		if newPath == "" {
-			return errors.New("no target path for patch")
-		}
-
-		var src io.ReaderAt
-		var srcFile *os.File
-		var err error
-		if !f.IsNew {
-			if oldPath == "" {
-				return errors.New("no source for non-new patch")
-			}
-			srcFile, err = os.Open(oldPath)
-			if err != nil {
-				return fmt.Errorf("failed to open %s: %w", oldPath, err)
-			}
-			src = srcFile
-		}
-
-		if !dry {
-			if err := os.MkdirAll(filepath.Dir(newPath), os.ModePerm); err != nil {
-				if srcFile != nil {
-					srcFile.Close()
-				}
-				return err
-			}
-		}
-
-		var output io.Writer
-		var tempFile *os.File
-		var tempName string
-		if dry {
-			var buf bytes.Buffer
-			output = &buf
-		} else {
-			tempFile, err = os.CreateTemp(filepath.Dir(newPath), "gitdiff_apply_*")
-			if err != nil {
-				if srcFile != nil {
-					srcFile.Close()
-				}
-				return err
-			}
-			tempName = tempFile.Name()
-			output = tempFile
-		}
-
-		if err := gitdiff.Apply(output, src, f); err != nil {
-			if srcFile != nil {
-				srcFile.Close()
-			}
-			if !dry {
-				tempFile.Close()
-				os.Remove(tempName)
-			}
-			return fmt.Errorf("failed to apply patch to %s: %w", f.NewName, err)
-		}
-
-		if srcFile != nil {
-			srcFile.Close()
-		}
-
-		if !dry {
-			if err := tempFile.Close(); err != nil {
-				os.Remove(tempName)
-				return err
-			}
-
-			if err := os.Rename(tempName, newPath); err != nil {
-				os.Remove(tempName)
-				return err
-			}
-
-			if f.NewMode != 0 {
-				if err := os.Chmod(newPath, f.NewMode); err != nil {
-					return fmt.Errorf("failed to set mode for %s: %w", newPath, err)
-				}
-			}
+type ApplyCmd struct {
+	Path  string `arg:"" name:"path" help:"The directory containing the Klarity project" type:"path"`
+	Patch string `arg:"" optional:"" name:"patch" help:"The path to the patch file to apply" type:"path"`
+	Yes   bool   `name:"yes" short:"y" help:"Apply the patch without previewing or confirming."`
+	Undo  bool   `name:"undo" help:"Revert the last patch applied to the project instead."`
 
-			if f.IsRename && oldPath != newPath {
-				if err := os.Remove(oldPath); err != nil {
-					return fmt.Errorf("failed to remove old file after rename %s: %w", oldPath, err)
-				}
-			}
-		}
-	}
-	return nil
+	Fuzz     int    `name:"fuzz" default:"2" help:"Lines of context at each end of a change that may be ignored to find where it goes, when the docs changed since the patch was made."`
+	Conflict string `name:"conflict" enum:"markers,reject" default:"markers" help:"What to do with changes that can't be placed: 'markers' puts them into the file between conflict markers, 'reject' writes them to a .rej file next to it."`
+	Atomic   bool   `name:"atomic" help:"Change nothing unless every file applies exactly, without conflicts or fuzzed changes."`
 }
 
-func (c *ApplyCmd) Run(ctx *kong.Context) error {
-	projectPath, err := filepath.Abs(c.Path)
+func (c *DoctorCmd) Run(ctx *kong.Context) error {
+	path, err := filepath.Abs(c.Path)
 	if err != nil {
 		return err
 	}
-	cfg := ReadConfig(projectPath)
-	_ = cfg
+	cfg := ReadConfig(path)
 
-	patchPath, err := filepath.Abs(c.Patch)
-	if err != nil {
-		return err
-	}
-	patchFile, err := os.Open(patchPath)
-	if err != nil {
-		return err
+	if cfg.Base_URL == "/" || cfg.Base_URL == "" {
+		slog.Warn("the base_url is not configured for distribution")
 	}
-	defer patchFile.Close()
 
-	patchContent, err := io.ReadAll(patchFile)
-	if err != nil {
-		return err
-	}
+	if len(cfg.Locales) > 0 {
+		if err := validateLocales(cfg); err != nil {
+			slog.Error("invalid [[locales]]", "err", err)
+		}
+	} else {
+		if cfg.Entry == "" {
+			slog.Error("no entry file configured")
+		}
 
-	if _, err := patchFile.Seek(0, 0); err != nil {
-		return err
+		if len(cfg.Doc_dirs) <= 0 {
+			slog.Error("no doc directories configured")
+		}
 	}
 
-	files, _, err := gitdiff.Parse(patchFile)
+	icons, err := validateFavicons(path)
 	if err != nil {
 		return err
 	}
 
-	if err := applyPatch(projectPath, files, true); err != nil {
-		return fmt.Errorf("patch does not apply cleanly: %w", err)
+	if len(icons) == 0 {
+		slog.Warn("no favicon detected in the root of the project")
+	} else if len(icons) > 1 {
+		slog.Warn("multiple favicons detected with different extensions", "favicons", icons)
 	}
 
-	if !c.Yes {
-		fmt.Println("Preview of changes:\n" + string(patchContent))
-		if !promptForConfirmation("Apply this patch?") {
-			fmt.Println("Patch application cancelled.")
-			return nil
+	if cfg.Templates_dir != "" {
+		if info, err := os.Stat(filepath.Join(path, cfg.Templates_dir)); err != nil || !info.IsDir() {
+			slog.Error("templates_dir does not exist", "templates_dir", cfg.Templates_dir)
+		} else if err := validateTemplates(path, cfg); err != nil {
+			slog.Error("invalid template override", "err", err)
 		}
-	}
-
-	if err := applyPatch(projectPath, files, false); err != nil {
-		return err
-	}
-
-	fmt.Println("Patch applied successfully")
-	return nil
-}
 
-func (c *DoctorCmd) Run(ctx *kong.Context) error {
-	path, err := filepath.Abs(c.Path)
-	if err != nil {
-		return err
-	}
-	cfg := ReadConfig(path)
-
-	if cfg.Base_URL == "/" || cfg.Base_URL == "" {
-		slog.Warn("the base_url is not configured for distribution")
+		outdated, err := outdatedEjected(path, cfg)
+		if err != nil {
+			return err
+		}
+		if len(outdated) > 0 {
+			slog.Warn("ejected files are older than the built-in versions, run klarity eject to see what changed", "files", outdated)
+		}
 	}
 
-	if cfg.Entry == "" {
-		slog.Error("no entry file configured")
+	if !slices.Contains(searchEngines, cfg.Build.Search) {
+		slog.Error("unknown build.search, use pagefind, builtin or none", "search", cfg.Build.Search)
 	}
 
-	if len(cfg.Doc_dirs) <= 0 {
-		slog.Error("no doc directories configured")
+	if len(cfg.Versions.List) > 0 {
+		if err := validateVersions(cfg); err != nil {
+			slog.Error("invalid [versions]", "err", err)
+		}
 	}
 
-	icons, err := validateFavicons(path)
-	if err != nil {
-		return err
+	sites := []Config{cfg}
+	if len(cfg.Locales) > 0 {
+		sites = nil
+		for _, l := range cfg.Locales {
+			sites = append(sites, localeConfig(cfg, l))
+		}
 	}
+	for _, sc := range sites {
+		docs, err := collectMarkdownFiles(sc, path)
+		if err != nil {
+			return err
+		}
 
-	if len(icons) == 0 {
-		slog.Warn("no favicon detected in the root of the project")
-	} else if len(icons) > 1 {
-		slog.Warn("multiple favicons detected with different extensions", "favicons", icons)
+		issues, err := checkLinks(path, sc, docs)
+		if err != nil {
+			return err
+		}
+		for _, issue := range issues {
+			slog.Warn("broken link", "at", issue.Pos(), "link", issue.Link, "problem", issue.Problem)
+		}
 	}
 
 	return nil
@@ -322,13 +228,13 @@ func promptForConfirmation(prompt string) bool {
 }
 
 func (c *BuildCmd) Run(ctx *kong.Context) error {
-	pwd = c.Path
-	InitMarkdown(pwd)
-	return buildKlarity(c.Path)
+	return buildKlarity(c.Path, buildOptions{Force: c.Force, Workers: c.Workers, Strict: c.Strict})
 }
 
 type PageData struct {
 	Title          string
+	Description    string
+	Tags           []string
 	Content        template.HTML
 	Base_URL       string
 	FaviconPath    string
@@ -336,47 +242,132 @@ type PageData struct {
 	CustomCSS      string
 	SPA            bool
 	NavTree        []*NavFolder
+	TOC            []*TOCEntry
 	Current        string
 	PageFindSearch string
 	EditorEnabled  bool
 	SourcePath     string
+	Version        string        // label of the version being built, empty without [versions]
+	Versions       []VersionLink // every version, for the switcher
+	Lang           string        // language of the page, for <html lang>
+	Locales        []LocaleLink  // the page in every locale, empty without [[locales]]
+}
+
+type editorData struct {
+	Base_URL  string
+	SourceDir string // where the source paths of pages are relative to, from the project root
 }
 
 type NavFolder struct {
-	Label string
-	Pages []*NavPage
-	Open  bool
+	Label   string
+	Path    string // relative to the doc dir, unlike the label it's unique
+	Folders []*NavFolder
+	Pages   []*NavPage
+	Open    bool
+
+	manifest NavManifest
 }
 
 type NavPage struct {
-	Title  string
-	URL    string
-	Active bool
+	Title    string
+	URL      string
+	Active   bool
+	Weight   int
+	External bool // a link from a nav manifest instead of a page
+
+	name string // file name, used to match it in nav manifests
+}
+
+type buildOptions struct {
+	Force   bool // ignore the build cache
+	Workers int  // overrides build.workers when > 0
+	Strict  bool // fail on broken links
+
+	NoSearch bool // skip the search index and UI
+	// OnSearch gets the pages of every site instead of the search index being generated,
+	// the dev server indexes them in the background
+	OnSearch func(searchJob)
+	// OutputDir replaces output_dir and Cache prefixes the names of the build caches,
+	// so the dev server never touches the output of klarity build
+	OutputDir string
+	Cache     string
+	// OnBuilt is told what changed in the output of every site that was built,
+	// the dev server uses it to update open pages in place
+	OnBuilt func(buildChanges)
+}
+
+// buildChanges is what a build changed in the output of a site
+type buildChanges struct {
+	Reload bool     // the whole site was rebuilt, e.g. because the config or templates changed
+	Nav    bool     // the sidebar changed
+	Pages  []string // URLs of pages written or removed
+	CSS    []string // URLs of stylesheets whose content changed
 }
 
-var tpl = template.Must(template.ParseFS(templates, "templates/layout.html"))
-var partial = template.Must(template.ParseFS(templates, "templates/partial.html"))
-var searchTpl = template.Must(template.ParseFS(templates, "templates/search.html"))
-var editor = template.Must(template.ParseFS(templates, "templates/editor.html"))
+// site is a single build of the docs into an output directory, projects with [versions]
+// build one site for each version
+type site struct {
+	root  string // project root with klarity.toml, templates and the build cache
+	src   string // where the docs are read from, the project root unless a version is built from elsewhere
+	cfg   Config // output_dir and base_url already point at where the site is served from
+	cache string // name of the build cache, empty for the main site of klarity build
 
-var config Config
+	version  string        // label of the version being built
+	versions []VersionLink // every version, for the switcher
+	nested   []string      // directories in the output that belong to other sites
 
-func buildKlarity(path string) error {
+	lang    string         // language of the locale being built
+	locales []*localeIndex // pages of every locale, for the switcher and hreflang links
+}
+
+func buildKlarity(path string, opts buildOptions) error {
 	path, err := filepath.Abs(path)
 	if err != nil {
 		return err
 	}
-	c := ReadConfig(path)
-	config = c
-	docs, err := collectMarkdownFiles(c, path)
+	c, err := loadConfig(path)
 	if err != nil {
 		return err
 	}
+	if opts.OutputDir != "" {
+		c.Output_dir = opts.OutputDir
+	}
 
-	navTree := buildNavTree(path, docs, c.Doc_dirs, c.Entry, c.Title)
+	if len(c.Versions.List) > 0 {
+		return buildVersions(path, c, opts)
+	}
+	return buildLocalized(site{root: path, src: path, cfg: c, cache: opts.Cache}, opts)
+}
+
+func buildSite(s site, opts buildOptions) error {
+	path, c := s.src, s.cfg
+
+	if !slices.Contains(searchEngines, c.Build.Search) {
+		return fmt.Errorf("unknown build.search %q, use pagefind, builtin or none", c.Build.Search)
+	}
+
+	tpls, err := loadTemplates(s.root, c)
+	if err != nil {
+		return err
+	}
+
+	cfgHash, tplHash := configHash(c), templatesHash(s.root, c)
+	prev, incremental := loadBuildCache(s.root, s.cache, cfgHash, tplHash)
+	if opts.Force {
+		prev, incremental = newBuildCache(cfgHash, tplHash), false
+	}
+	next := newBuildCache(cfgHash, tplHash)
+	docs, err := collectMarkdownFiles(c, path)
+	if err != nil {
+		return err
+	}
+	static, err := collectStaticFiles(c, path)
+	if err != nil {
+		return err
+	}
 
 	var faviconPath string
-	icons, err := validateFavicons(path)
+	icons, err := validateFavicons(s.root)
 	if err != nil {
 		return err
 	}
@@ -386,7 +377,7 @@ func buildKlarity(path string) error {
 	} else {
 		if len(icons) == 0 {
 		} else {
-			faviconPath = filepath.Join(path, c.Output_dir, filepath.Base(icons[0])) // probably needs better picking
+			faviconPath = filepath.Join(s.root, c.Output_dir, filepath.Base(icons[0])) // probably needs better picking
 		}
 	}
 
@@ -399,21 +390,65 @@ func buildKlarity(path string) error {
 	}
 
 	html_docs := make(map[string]string)
-	for _, doc := range docs {
-		b, err := os.ReadFile(doc)
-		if err != nil {
-			return err
+	meta := make(map[string]FrontMatter)
+	var published []string
+	rendered := 0
+
+	workers := c.Build.Workers
+	if opts.Workers > 0 {
+		workers = opts.Workers
+	}
+	results := renderPages(newMarkdown(c), path, c, docs, prev, workers)
+	for i, doc := range docs {
+		res := results[i]
+		if res.err != nil {
+			return res.err
+		}
+		if res.fresh {
+			rendered++
 		}
-		currentlyRendering = doc
-		html, err := renderMarkdown(b)
+
+		relPath, _ := filepath.Rel(path, doc)
+		next.Pages[relPath] = &cachedPage{Source: res.sum, HTML: res.html, Meta: res.fm, Assets: res.assets, Deps: res.deps, TOC: res.toc, Search: res.search}
+
+		if !isPublished(res.fm) {
+			continue
+		}
+		html_docs[doc] = res.html
+		meta[doc] = res.fm
+		published = append(published, doc)
+	}
+
+	if incremental {
+		fmt.Printf("Rendered %d of %d pages, the rest is unchanged\n", rendered, len(docs))
+	}
+
+	if opts.Strict {
+		issues, err := checkLinks(path, c, published)
 		if err != nil {
 			return err
 		}
-		currentlyRendering = ""
-		html_docs[doc] = html
+		for _, issue := range issues {
+			fmt.Fprintln(os.Stderr, issue)
+		}
+		if len(issues) > 0 {
+			return fmt.Errorf("found %d broken links", len(issues))
+		}
 	}
 
-	c.Output_dir, err = cleanOutputDir(path, c.Output_dir)
+	navTree, err := buildNavTree(path, published, c, meta)
+	if err != nil {
+		return err
+	}
+	navJSON, _ := json.Marshal(navTree)
+	next.Nav = hashBytes(navJSON)
+
+	// an unusable cache means we can't know what is stale in the output, so start clean
+	if incremental {
+		c.Output_dir, err = filepath.Abs(filepath.Join(s.root, c.Output_dir))
+	} else {
+		c.Output_dir, err = cleanOutputDir(s.root, c.Output_dir)
+	}
 	if err != nil {
 		return err
 	}
@@ -428,7 +463,7 @@ func buildKlarity(path string) error {
 			return err
 		}
 
-		for _, doc := range docs {
+		for _, doc := range published {
 			relPath, _ := filepath.Rel(path, doc)
 			destPath := filepath.Join(rawOutputDir, relPath)
 
@@ -441,10 +476,13 @@ func buildKlarity(path string) error {
 			}
 		}
 
-		data := struct {
-			Base_URL string
-		}{
-			Base_URL: normalizeURL(c.Base_URL),
+		sourceDir, _ := filepath.Rel(s.root, s.src)
+		if sourceDir == "." {
+			sourceDir = ""
+		}
+		data := editorData{
+			Base_URL:  normalizeURL(c.Base_URL),
+			SourceDir: filepath.ToSlash(sourceDir),
 		}
 
 		editorPath := filepath.Join(c.Output_dir, "editor.html")
@@ -453,7 +491,7 @@ func buildKlarity(path string) error {
 			return fmt.Errorf("error creating file '%s': %w", editorPath, err)
 		}
 
-		if err := editor.Execute(editorFile, data); err != nil {
+		if err := tpls.editor.Execute(editorFile, data); err != nil {
 			editorFile.Close()
 			return fmt.Errorf("error rendering template to '%s': %w", editorPath, err)
 		}
@@ -461,13 +499,17 @@ func buildKlarity(path string) error {
 
 	entry := filepath.Clean(filepath.Join(path, c.Entry))
 
+	written := make(map[string]bool)
+	changed := 0
+	changes := buildChanges{Reload: !incremental, Nav: next.Nav != prev.Nav}
+	var searchPages []searchPage
 	for f, page := range html_docs {
 		relPath, err := filepath.Rel(path, f)
 		if err != nil {
 			return fmt.Errorf("unable to determine relative path for '%s': %w", f, err)
 		}
 
-		outPath := filepath.Join(c.Output_dir, strings.TrimSuffix(relPath, filepath.Ext(relPath))+".html")
+		outPath := filepath.Join(c.Output_dir, pageOutPath(path, c, f))
 
 		if err := os.MkdirAll(filepath.Dir(outPath), os.ModePerm); err != nil {
 			return fmt.Errorf("failed to create directory for '%s': %w", outPath, err)
@@ -485,6 +527,11 @@ func buildKlarity(path string) error {
 			isEntry = false
 		}
 
+		fm := meta[f]
+		if fm.Title != "" {
+			pageTitle = fm.Title
+		}
+
 		var relURL string
 		if isEntry {
 			relURL = "/"
@@ -505,6 +552,8 @@ func buildKlarity(path string) error {
 
 		data := PageData{
 			Title:         pageTitle,
+			Description:   fm.Description,
+			Tags:          fm.Tags,
 			Content:       template.HTML(page),
 			Base_URL:      normalizeURL(c.Base_URL),
 			FaviconPath:   dot_to_blank(filepath.Base(faviconPath)),
@@ -512,38 +561,105 @@ func buildKlarity(path string) error {
 			SPA:           c.Visual.SPA,
 			CustomCSS:     dot_to_blank(filepath.Base(c.Visual.CustomCSS)),
 			NavTree:       navTree,
+			TOC:           next.Pages[relPath].TOC,
 			Current:       relURL,
 			EditorEnabled: c.Editor.Enable,
 			SourcePath:    filepath.ToSlash(relPath),
+			Version:       s.version,
+			Versions:      s.versions,
+			Lang:          cmp.Or(s.lang, defaultLang),
+			Locales:       s.localeLinks(localePageKey(path, c, f)),
 		}
 
-		for _, folder := range data.NavTree {
-			folder.Open = false
-			for _, pg := range folder.Pages {
-				if pg.URL == data.Current {
-					pg.Active = true
-					folder.Open = true
-				}
-			}
-		}
-
-		outFile, err := os.Create(outPath)
-		if err != nil {
-			return fmt.Errorf("error creating file '%s': %w", outPath, err)
-		}
+		// nav URLs include base_url, Current doesn't
+		markActive(data.NavTree, normalizeURL(c.Base_URL)+data.Current)
+		searchPages = append(searchPages, searchPage{URL: data.Base_URL + data.Current, Title: pageTitle, Sections: next.Pages[relPath].Search})
 
+		var buf bytes.Buffer
 		// if isEntry {
-		if err := tpl.Execute(outFile, data); err != nil {
-			outFile.Close()
-			return fmt.Errorf("error rendering template to '%s': %w", outPath, err)
+		if err := tpls.layout.Execute(&buf, data); err != nil {
+			return templateError(s.root, c, fmt.Errorf("error rendering template to '%s': %w", outPath, err))
 		}
 		// } else {
-		// 	if err := partial.Execute(outFile, data); err != nil {
-		// 		outFile.Close()
+		// 	if err := tpls.partial.Execute(&buf, data); err != nil {
 		// 		return fmt.Errorf("error rendering template to '%s': %w", outPath, err)
 		// 	}
 		// }
-		outFile.Close()
+
+		relOutPath, _ := filepath.Rel(c.Output_dir, outPath)
+		entryCache := next.Pages[relPath]
+		entryCache.Output = hashBytes(buf.Bytes())
+		entryCache.OutPath = relOutPath
+		written[relOutPath] = true
+
+		if old, ok := prev.Pages[relPath]; ok && old.Output == entryCache.Output && old.OutPath == relOutPath {
+			if _, err := os.Stat(outPath); err == nil {
+				continue
+			}
+		}
+
+		if err := os.WriteFile(outPath, buf.Bytes(), 0644); err != nil {
+			return fmt.Errorf("error creating file '%s': %w", outPath, err)
+		}
+		changed++
+		changes.Pages = append(changes.Pages, data.Base_URL+data.Current)
+	}
+
+	// drop pages whose source was removed, renamed or turned into a draft since the last build
+	for relPath, old := range prev.Pages {
+		if old.OutPath == "" || written[old.OutPath] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(c.Output_dir, old.OutPath)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove stale page '%s': %w", old.OutPath, err)
+		}
+		os.Remove(filepath.Join(c.Output_dir, "_klarity_raw", relPath))
+		changed++
+		changes.Pages = append(changes.Pages, normalizeURL(c.Base_URL)+"/"+filepath.ToSlash(old.OutPath))
+	}
+
+	// copy over static files and the files published pages link to or embed, then drop the ones that are gone
+	assetSet := make(map[string]bool)
+	for _, file := range static {
+		rel := relOrAbs(path, file)
+		next.Static = append(next.Static, rel)
+		assetSet[rel] = true
+	}
+	for _, doc := range published {
+		relPath, _ := filepath.Rel(path, doc)
+		for _, asset := range next.Pages[relPath].Assets {
+			assetSet[asset] = true
+		}
+	}
+	for asset := range assetSet {
+		src := filepath.Join(path, filepath.FromSlash(asset))
+		if _, err := os.Stat(src); os.IsNotExist(err) {
+			delete(assetSet, asset) // removed while building
+			continue
+		}
+		if err := SyncFile(src, filepath.Join(c.Output_dir, filepath.FromSlash(asset))); err != nil {
+			return fmt.Errorf("failed to copy '%s' to the output: %w", asset, err)
+		}
+	}
+	oldAssets := slices.Clone(prev.Static)
+	for _, old := range prev.Pages {
+		oldAssets = append(oldAssets, old.Assets...)
+	}
+	for _, asset := range oldAssets {
+		if !assetSet[asset] && !written[filepath.FromSlash(asset)] {
+			os.Remove(filepath.Join(c.Output_dir, filepath.FromSlash(asset)))
+		}
+	}
+
+	// stylesheets are written on every build, only the ones whose content changed are reported
+	stylesheets := []string{"style.css", "vars.css"}
+	if c.Visual.CustomCSS != "" {
+		stylesheets = append(stylesheets, filepath.Base(c.Visual.CustomCSS))
+	}
+	cssHashes := make(map[string]string, len(stylesheets))
+	for _, name := range stylesheets {
+		b, _ := os.ReadFile(filepath.Join(c.Output_dir, name))
+		cssHashes[name] = hashBytes(b)
 	}
 
 	f, err := os.Create(filepath.Join(c.Output_dir, "style.css"))
@@ -551,11 +667,19 @@ func buildKlarity(path string) error {
 		return err
 	}
 	defer f.Close()
-	built_in_css, err := assets.ReadFile("assets/style.min.css")
-	if err != nil {
-		return err
+	var css []byte
+	if c.Visual.Style != "" {
+		css, err = os.ReadFile(filepath.Join(s.root, c.Visual.Style))
+		if err != nil {
+			return fmt.Errorf("failed to read visual.style: %w", err)
+		}
+	} else {
+		css, err = assets.ReadFile("assets/style.min.css")
+		if err != nil {
+			return err
+		}
 	}
-	f.Write(built_in_css)
+	f.Write(css)
 
 	if c.Ignore_out {
 		ignoreTemplate := `# THIS FILE IS AUTOMATICALLY GENERATED, DO NOT MODIFY!
@@ -573,7 +697,7 @@ func buildKlarity(path string) error {
 		ignore.WriteString(ignoreTemplate)
 	} else {
 		err := os.Remove(filepath.Join(c.Output_dir, ".gitignore"))
-		if err != nil {
+		if err != nil && !os.IsNotExist(err) {
 			return fmt.Errorf("could not remove .gitignore from %s", c.Output_dir)
 		}
 	}
@@ -593,36 +717,29 @@ func buildKlarity(path string) error {
 		}
 	}
 
-	pagefindGenerated := false
-	var pagefind []string = nil
-	if _, err := exec.LookPath("pagefind"); err == nil {
-		pagefind = []string{"pagefind"}
-	} else if _, err := exec.LookPath("npx"); err == nil {
-		pagefind = []string{"npx", "-y", "pagefind"}
-	} else {
-		slog.Warn("pagefind nor npx could be found in PATH, skipping Pagefind search index generation")
+	for _, name := range stylesheets {
+		b, _ := os.ReadFile(filepath.Join(c.Output_dir, name))
+		if hashBytes(b) != cssHashes[name] {
+			changes.CSS = append(changes.CSS, normalizeURL(c.Base_URL)+"/"+name)
+		}
 	}
 
-	if pagefind != nil {
-		_cmd := append(pagefind, "--site", c.Output_dir, "--output-subdir", "pagefind")
-		cmd := exec.Command(_cmd[0], _cmd[1:]...)
-
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		if err := cmd.Run(); err == nil {
-			pagefindGenerated = true
-			fmt.Println("Pagefind search index generated")
-		} else {
-			slog.Warn("Pagefind failed to generate index (search will be disabled)", "error", err)
-		}
+	if err := next.save(s.root, s.cache); err != nil {
+		slog.Warn("failed to write the build cache", "error", err)
 	}
 
-	if pagefindGenerated {
-		if err := injectSearchUI(c.Output_dir, normalizeURL(c.Base_URL)); err != nil {
-			slog.Error("Failed to inject search UI (search disabled)", "error", err)
-		}
+	switch {
+	case opts.NoSearch || c.Build.Search == "none":
+	case opts.OnSearch != nil:
+		opts.OnSearch(searchJob{tpl: tpls.search, outputDir: c.Output_dir, baseURL: normalizeURL(c.Base_URL), pages: searchPages})
+	case changed > 0 || !searchIndexExists(c):
+		// the search index only has to be regenerated if some page actually changed
+		buildSearch(tpls.search, s, c, written, searchPages)
 	}
 
+	if opts.OnBuilt != nil {
+		opts.OnBuilt(changes)
+	}
 	return nil
 }
 
@@ -636,6 +753,9 @@ func (c *CleanCmd) Run(ctx *kong.Context) error {
 	if err != nil {
 		return err
 	}
+	if err := clearBuildCache(path); err != nil {
+		return err
+	}
 	fmt.Println("cleaned all build artifacts from", cfg.Output_dir)
 	return nil
 }
@@ -654,8 +774,6 @@ func cleanOutputDir(basePath, outputDir string) (string, error) {
 }
 
 func (c *InitCmd) Run(ctx *kong.Context) error {
-	pwd = c.Path
-	// InitMarkdown(pwd)
 	return initKlarity(c.Path)
 }
 
@@ -695,7 +813,7 @@ func alreadyExists(path string) initState {
 	config := ReadConfig(path)
 	mdFileExists := false
 
-	for _, docDir := range config.Doc_dirs {
+	for _, docDir := range allDocDirs(config) {
 		docsPath := filepath.Join(path, docDir)
 		if _, err := os.Stat(docsPath); os.IsNotExist(err) {
 			continue
@@ -746,7 +864,7 @@ func initKlarity(path string) error {
 			return nil
 		}
 		c := ReadConfig(path)
-		for _, dir := range c.Doc_dirs {
+		for _, dir := range allDocDirs(c) {
 			os.RemoveAll(filepath.Join(path, dir))
 		}
 		os.Remove(filepath.Join(path, "klarity.toml"))
@@ -1,35 +1,52 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"path"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+	"go.abhg.dev/goldmark/frontmatter"
 )
 
-func buildNavTree(root string, docs []string, docDirs []string, entry string, siteTitle string) []*NavFolder {
-	absDocDirs := make([]string, 0, len(docDirs))
-	for _, dd := range docDirs {
+func buildNavTree(root string, docs []string, c Config, meta map[string]FrontMatter) ([]*NavFolder, error) {
+	absDocDirs := make([]string, 0, len(c.Doc_dirs))
+	for _, dd := range c.Doc_dirs {
 		abs := filepath.Clean(filepath.Join(root, dd))
 		absDocDirs = append(absDocDirs, abs)
 	}
 
-	base := normalizeURL(ReadConfig(root).Base_URL)
+	base := normalizeURL(c.Base_URL)
 
 	entryAbs := ""
-	if entry != "" {
-		entryAbs = filepath.Clean(filepath.Join(root, entry))
+	if c.Entry != "" {
+		entryAbs = filepath.Clean(filepath.Join(root, c.Entry))
 	}
 
-	folderMap := make(map[string][]*NavPage)
+	rootFolder := &NavFolder{Open: true}
+	var entryPage *NavPage
+	folders := map[string]*NavFolder{"": rootFolder}
 
 	for _, absPath := range docs {
 		cleanPath := filepath.Clean(absPath)
+		fm := meta[absPath]
 
 		if entryAbs != "" && cleanPath == entryAbs {
-			folderMap[""] = append(folderMap[""], &NavPage{
-				Title: siteTitle,
+			title := c.Title
+			if fm.Title != "" {
+				title = fm.Title
+			}
+			entryPage = &NavPage{
+				Title: title,
 				URL:   base + "/",
-			})
+			}
 			continue
 		}
 
@@ -51,81 +68,210 @@ func buildNavTree(root string, docs []string, docDirs []string, entry string, si
 			continue
 		}
 
-		relToRoot, err := filepath.Rel(root, cleanPath)
-		if err != nil {
-			continue
-		}
-		url := base + "/" + strings.TrimSuffix(filepath.ToSlash(relToRoot), ".md") + ".html"
+		url := base + "/" + filepath.ToSlash(pageOutPath(root, c, cleanPath))
 
-		parts := strings.Split(filepath.ToSlash(relInDocDir), "/")
-		var folderKey string
-		var pageTitle string
-		if len(parts) == 1 {
-			folderKey = ""
-			pageTitle = strings.TrimSuffix(parts[0], ".md")
-		} else {
-			folderKey = parts[0]
-			pageTitle = strings.TrimSuffix(parts[len(parts)-1], ".md")
+		relInDocDir = filepath.ToSlash(relInDocDir)
+		pageTitle := strings.TrimSuffix(path.Base(relInDocDir), ".md")
+		if fm.Title != "" {
+			pageTitle = fm.Title
 		}
 
-		folderMap[folderKey] = append(folderMap[folderKey], &NavPage{
-			Title: pageTitle,
-			URL:   url,
+		folder := navFolder(folders, path.Dir(relInDocDir))
+		folder.Pages = append(folder.Pages, &NavPage{
+			Title:  pageTitle,
+			URL:    url,
+			Weight: fm.Weight,
+			name:   path.Base(relInDocDir),
 		})
 	}
 
-	var out []*NavFolder
+	for dir, f := range folders {
+		m, err := loadNavManifest(absDocDirs, dir, c.Nav)
+		if err != nil {
+			return nil, err
+		}
+		f.manifest = m
+	}
+	applyNavManifest(rootFolder)
+	if entryPage != nil {
+		if label, ok := rootFolder.manifest.label(filepath.Base(entryAbs)); ok {
+			entryPage.Title = label
+		}
+		// the entry always comes first, regardless of weight
+		rootFolder.Pages = append([]*NavPage{entryPage}, rootFolder.Pages...)
+	}
 
-	if pages, ok := folderMap[""]; ok {
-		var entryPage *NavPage
-		var otherPages []*NavPage
-		for _, p := range pages {
-			if p.URL == base+"/" {
-				entryPage = p
-			} else {
-				otherPages = append(otherPages, p)
+	// top level folders are listed next to the root pages instead of inside a folder
+	out := []*NavFolder{rootFolder}
+	out = append(out, rootFolder.Folders...)
+	rootFolder.Folders = nil
+	if len(rootFolder.Pages) == 0 {
+		out = out[1:]
+	}
+
+	return out, nil
+}
+
+// navFolder returns the folder at dir (slash separated, relative to its doc dir),
+// creating it and any missing parents
+func navFolder(folders map[string]*NavFolder, dir string) *NavFolder {
+	if dir == "." {
+		dir = ""
+	}
+	if f, ok := folders[dir]; ok {
+		return f
+	}
+
+	parent := navFolder(folders, path.Dir(dir))
+	f := &NavFolder{
+		Label: path.Base(dir),
+		Path:  dir,
+	}
+	parent.Folders = append(parent.Folders, f)
+	folders[dir] = f
+	return f
+}
+
+// markActive marks the page with the given URL as active and opens every folder on the way to it,
+// everything else is reset so the same tree can be reused for each page
+func markActive(folders []*NavFolder, current string) bool {
+	found := false
+	for _, f := range folders {
+		f.Open = f.Label == ""
+		for _, pg := range f.Pages {
+			pg.Active = pg.URL == current
+			if pg.Active {
+				f.Open = true
+				found = true
 			}
 		}
+		if markActive(f.Folders, current) {
+			f.Open = true
+			found = true
+		}
+	}
+	return found
+}
 
-		sort.Slice(otherPages, func(i, j int) bool {
-			return otherPages[i].Title < otherPages[j].Title
-		})
+// loadNavManifest finds the manifest of a folder, the first _nav.toml or _index.md in the folder
+// of any doc dir is used, then the [nav] section of klarity.toml
+func loadNavManifest(docDirs []string, dir string, cfg NavConfig) (NavManifest, error) {
+	var m NavManifest
+	for _, dd := range docDirs {
+		folder := filepath.Join(dd, filepath.FromSlash(dir))
 
-		var sortedPages []*NavPage
-		if entryPage != nil {
-			sortedPages = append(sortedPages, entryPage)
+		navFile := filepath.Join(folder, "_nav.toml")
+		if _, err := os.Stat(navFile); err == nil {
+			if _, err := toml.DecodeFile(navFile, &m); err != nil {
+				return m, fmt.Errorf("invalid nav manifest %s: %w", navFile, err)
+			}
+			return m, nil
 		}
-		sortedPages = append(sortedPages, otherPages...)
 
-		out = append(out, &NavFolder{
-			Label: "",
-			Pages: sortedPages,
-			Open:  true,
-		})
+		indexFile := filepath.Join(folder, "_index.md")
+		if src, err := os.ReadFile(indexFile); err == nil {
+			ctx := parser.NewContext()
+			goldmark.New(goldmark.WithExtensions(&frontmatter.Extender{})).Parser().Parse(text.NewReader(src), parser.WithContext(ctx))
+			if data := frontmatter.Get(ctx); data != nil {
+				if err := data.Decode(&m); err != nil {
+					return m, fmt.Errorf("invalid nav manifest %s: %w", indexFile, err)
+				}
+			}
+			return m, nil
+		}
 	}
 
-	var keys []string
-	for k := range folderMap {
-		if k == "" {
+	if dir == "" {
+		return cfg.NavManifest, nil
+	}
+	return cfg.Folders[dir], nil
+}
+
+// applyNavManifest relabels, hides and orders the contents of f and its subfolders,
+// whatever the manifest doesn't mention keeps the default order
+func applyNavManifest(f *NavFolder) {
+	m := f.manifest
+
+	pages := f.Pages[:0]
+	for _, pg := range f.Pages {
+		if m.hides(pg.name) {
 			continue
 		}
-		keys = append(keys, k)
+		if label, ok := m.label(pg.name); ok {
+			pg.Title = label
+		}
+		pages = append(pages, pg)
+	}
+	for _, l := range m.Links {
+		pages = append(pages, &NavPage{Title: l.Title, URL: l.URL, External: true, name: l.Title})
 	}
-	sort.Strings(keys)
+	f.Pages = pages
 
-	for _, key := range keys {
-		pages := folderMap[key]
-		sort.Slice(pages, func(i, j int) bool {
-			return pages[i].Title < pages[j].Title
-		})
+	folders := f.Folders[:0]
+	for _, sub := range f.Folders {
+		name := path.Base(sub.Path)
+		if m.hides(name) {
+			continue
+		}
+		if sub.manifest.Title != "" {
+			sub.Label = sub.manifest.Title
+		}
+		if label, ok := m.label(name); ok {
+			sub.Label = label
+		}
+		applyNavManifest(sub)
+		folders = append(folders, sub)
+	}
+	f.Folders = folders
+
+	sortNavPages(f.Pages, m.Order)
+	sort.SliceStable(f.Folders, func(i, j int) bool {
+		ri, rj := navRank(m.Order, path.Base(f.Folders[i].Path)), navRank(m.Order, path.Base(f.Folders[j].Path))
+		if ri != rj {
+			return ri < rj
+		}
+		return f.Folders[i].Label < f.Folders[j].Label
+	})
+}
+
+// names in a manifest can leave out the .md extension
+func navNameMatches(want, name string) bool {
+	return want == name || want+".md" == name
+}
+
+func (m NavManifest) hides(name string) bool {
+	return slices.ContainsFunc(m.Hide, func(h string) bool { return navNameMatches(h, name) })
+}
 
-		nf := &NavFolder{
-			Label: key,
-			Pages: pages,
-			Open:  false,
+func (m NavManifest) label(name string) (string, bool) {
+	for k, v := range m.Labels {
+		if navNameMatches(k, name) {
+			return v, true
 		}
-		out = append(out, nf)
 	}
+	return "", false
+}
 
-	return out
+// navRank is the position of name in order, names that aren't listed come last
+func navRank(order []string, name string) int {
+	i := slices.IndexFunc(order, func(o string) bool { return navNameMatches(o, name) })
+	if i < 0 {
+		return len(order)
+	}
+	return i
+}
+
+// pages listed in the manifest come first, the rest is sorted by front matter weight
+// (lower comes first), ties are alphabetical
+func sortNavPages(pages []*NavPage, order []string) {
+	sort.SliceStable(pages, func(i, j int) bool {
+		ri, rj := navRank(order, pages[i].name), navRank(order, pages[j].name)
+		if ri != rj {
+			return ri < rj
+		}
+		if pages[i].Weight != pages[j].Weight {
+			return pages[i].Weight < pages[j].Weight
+		}
+		return pages[i].Title < pages[j].Title
+	})
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBuildNavTreeNested(t *testing.T) {
+	root := createTempDir(t)
+	defer os.RemoveAll(root)
+
+	paths := writeTestDocs(t, root, map[string]string{
+		"klarity.toml":              "base_url = \"/\"\n",
+		"docs/main.md":              "",
+		"docs/intro.md":             "",
+		"docs/api/index.md":         "",
+		"docs/api/v2/auth.md":       "",
+		"docs/api/v2/users.md":      "",
+		"docs/api/v1/auth.md":       "",
+		"docs/guides/v2/upgrade.md": "",
+	})
+	var docs []string
+	for _, p := range paths {
+		if filepath.Ext(p) == ".md" {
+			docs = append(docs, p)
+		}
+	}
+
+	c := Config{Title: "Site", Base_URL: "/", Doc_dirs: []string{"docs"}, Entry: "docs/main.md"}
+	tree, err := buildNavTree(root, docs, c, nil)
+	if err != nil {
+		t.Fatalf("buildNavTree() failed: %v", err)
+	}
+	if len(tree) != 3 {
+		t.Fatalf("buildNavTree() returned %d top level folders, want 3", len(tree))
+	}
+	if tree[0].Label != "" || len(tree[0].Pages) != 2 || tree[0].Pages[0].URL != "/" {
+		t.Errorf("unexpected root folder: %+v", tree[0])
+	}
+
+	api := tree[1]
+	if api.Label != "api" || len(api.Pages) != 1 || len(api.Folders) != 2 {
+		t.Fatalf("unexpected api folder: %+v", api)
+	}
+	v2 := api.Folders[1]
+	if v2.Label != "v2" || v2.Path != "api/v2" || len(v2.Pages) != 2 {
+		t.Fatalf("unexpected api/v2 folder: %+v", v2)
+	}
+	if tree[2].Folders[0].Path != "guides/v2" {
+		t.Errorf("folders with the same name got mixed up: %+v", tree[2].Folders[0])
+	}
+
+	if !markActive(tree, "/docs/api/v2/users.html") {
+		t.Fatalf("markActive() did not find the page")
+	}
+	if !api.Open || !v2.Open || api.Folders[0].Open || tree[2].Open {
+		t.Errorf("markActive() should open only the ancestors of the active page")
+	}
+	if !v2.Pages[1].Active || v2.Pages[0].Active {
+		t.Errorf("markActive() marked the wrong page: %+v", v2.Pages)
+	}
+
+	markActive(tree, "/")
+	if api.Open || v2.Open || v2.Pages[1].Active {
+		t.Errorf("markActive() didn't reset the previous page")
+	}
+}
+
+func TestBuildNavTreeManifest(t *testing.T) {
+	root := createTempDir(t)
+	defer os.RemoveAll(root)
+
+	paths := writeTestDocs(t, root, map[string]string{
+		"docs/main.md":          "",
+		"docs/Advanced.md":      "",
+		"docs/Introduction.md":  "",
+		"docs/Secret.md":        "",
+		"docs/api/auth.md":      "",
+		"docs/api/users.md":     "",
+		"docs/api/_nav.toml":    "title = \"API Reference\"\norder = [\"users\"]\n",
+		"docs/guides/setup.md":  "",
+		"docs/guides/_index.md": "---\norder: [GitHub]\nlinks:\n  - title: GitHub\n    url: https://github.com\n---\n",
+		"docs/internal/x.md":    "",
+	})
+	var docs []string
+	for _, p := range paths {
+		if filepath.Ext(p) == ".md" && filepath.Base(p) != "_index.md" {
+			docs = append(docs, p)
+		}
+	}
+
+	c := Config{Base_URL: "/", Doc_dirs: []string{"docs"}, Entry: "docs/main.md"}
+	c.Nav.Order = []string{"Introduction.md", "guides"}
+	c.Nav.Hide = []string{"Secret", "internal"}
+	c.Nav.Labels = map[string]string{"main.md": "Home"}
+
+	tree, err := buildNavTree(root, docs, c, nil)
+	if err != nil {
+		t.Fatalf("buildNavTree() failed: %v", err)
+	}
+
+	var got []string
+	for _, f := range tree {
+		got = append(got, "["+f.Label+"]")
+		for _, p := range f.Pages {
+			got = append(got, p.Title)
+		}
+	}
+	want := "[] Home Introduction Advanced [guides] GitHub setup [API Reference] users auth"
+	if strings.Join(got, " ") != want {
+		t.Errorf("buildNavTree() = %s, want %s", strings.Join(got, " "), want)
+	}
+	if !tree[1].Pages[0].External || tree[1].Pages[0].URL != "https://github.com" {
+		t.Errorf("expected an external link, got %+v", tree[1].Pages[0])
+	}
+}
@@ -2,23 +2,114 @@ package main
 
 import (
 	"bytes"
+	"cmp"
 	"fmt"
+	"html/template"
 	"io/fs"
+	"log/slog"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
 )
 
-func injectSearchUI(outputDir, baseURL string) error {
+// values of build.search, empty is the same as pagefind
+var searchEngines = []string{"", "pagefind", "builtin", "none"}
+
+// searchJob is a site whose search index is generated outside of the build
+type searchJob struct {
+	tpl       *template.Template
+	outputDir string // absolute
+	baseURL   string // normalized
+	pages     []searchPage
+}
+
+type searchData struct {
+	BundlePath string
+	Engine     string // pagefind or builtin
+}
+
+// searchIndexExists reports whether output_dir has the index of the configured search engine,
+// or the built-in one pagefind fell back to
+func searchIndexExists(c Config) bool {
+	dirs := []string{"pagefind", searchIndexDir}
+	switch c.Build.Search {
+	case "builtin":
+		dirs = []string{searchIndexDir}
+	case "none":
+		return true
+	}
+	for _, dir := range dirs {
+		if _, err := os.Stat(filepath.Join(c.Output_dir, dir)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// buildSearch generates the search index of a site and adds the search UI to its pages,
+// pagefind falls back to the built-in index if it can't be run
+func buildSearch(tpl *template.Template, s site, c Config, written map[string]bool, pages []searchPage) {
+	if cmp.Or(c.Build.Search, "pagefind") == "pagefind" {
+		err := runPagefind(s, c, written)
+		if err == nil {
+			fmt.Println("Pagefind search index generated")
+			if err := injectSearchUI(tpl, c.Output_dir, normalizeURL(c.Base_URL), "pagefind", s.nested); err != nil {
+				slog.Error("Failed to inject search UI (search disabled)", "error", err)
+			}
+			return
+		}
+		slog.Warn("Pagefind failed to generate index, using the built-in search index instead", "error", err)
+	}
+
+	slices.SortFunc(pages, func(a, b searchPage) int { return strings.Compare(a.URL, b.URL) })
+	if err := writeSearchIndex(c.Output_dir, pages); err != nil {
+		slog.Error("Failed to write the search index (search disabled)", "error", err)
+		return
+	}
+	fmt.Println("Search index generated")
+	if err := injectSearchUI(tpl, c.Output_dir, normalizeURL(c.Base_URL), "builtin", s.nested); err != nil {
+		slog.Error("Failed to inject search UI (search disabled)", "error", err)
+	}
+}
+
+func runPagefind(s site, c Config, written map[string]bool) error {
+	var pagefind []string
+	if _, err := exec.LookPath("pagefind"); err == nil {
+		pagefind = []string{"pagefind"}
+	} else if _, err := exec.LookPath("npx"); err == nil {
+		pagefind = []string{"npx", "-y", "pagefind"}
+	} else {
+		return fmt.Errorf("pagefind nor npx could be found in PATH")
+	}
+
+	args := append(pagefind, "--site", c.Output_dir, "--output-subdir", "pagefind")
+	if len(s.nested) > 0 {
+		// other sites in the output have their own index
+		args = append(args, "--glob", searchGlob(written))
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// injectSearchUI adds the search UI to every page in outputDir, except for the ones
+// in nested directories that belong to another site with its own search index
+func injectSearchUI(searchTpl *template.Template, outputDir, baseURL, engine string, nested []string) error {
 	normalized := normalizeURL(baseURL)
 	if !strings.HasSuffix(normalized, "/") {
 		normalized += "/"
 	}
 
-	data := struct {
-		BundlePath string
-	}{
-		BundlePath: normalized + "pagefind/",
+	bundle := "pagefind/"
+	if engine == "builtin" {
+		bundle = searchIndexDir + "/"
+	}
+	data := searchData{
+		BundlePath: normalized + bundle,
+		Engine:     engine,
 	}
 
 	var buf bytes.Buffer
@@ -28,6 +119,9 @@ func injectSearchUI(outputDir, baseURL string) error {
 	searchHTML := buf.String()
 
 	return filepath.WalkDir(outputDir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() && filepath.Dir(path) == outputDir && slices.Contains(nested, d.Name()) {
+			return filepath.SkipDir
+		}
 		if err != nil || d.IsDir() || !strings.HasSuffix(path, ".html") {
 			return nil
 		}
@@ -42,7 +136,8 @@ func injectSearchUI(outputDir, baseURL string) error {
 			return err
 		}
 
-		if !bytes.Contains(content, []byte("</body>")) {
+		// pages kept from an earlier incremental build already have the search UI
+		if !bytes.Contains(content, []byte("</body>")) || bytes.Contains(content, []byte(`id="klarity-search-floating"`)) {
 			return nil
 		}
 
@@ -54,3 +149,19 @@ func injectSearchUI(outputDir, baseURL string) error {
 		return os.WriteFile(path, newContent, 0644)
 	})
 }
+
+// searchGlob matches only the pages of a site for pagefind, written are the pages it wrote
+// relative to the output directory
+func searchGlob(written map[string]bool) string {
+	var parts []string
+	for rel := range written {
+		top, _, nested := strings.Cut(filepath.ToSlash(rel), "/")
+		if nested {
+			top += "/**/*.html"
+		}
+		parts = append(parts, top)
+	}
+	slices.Sort(parts)
+	parts = slices.Compact(parts)
+	return "{" + strings.Join(parts, ",") + "}"
+}
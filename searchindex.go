@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+)
+
+// where the built-in search index is written in output_dir
+const searchIndexDir = "_klarity_search"
+
+// pages per file of section text, results only load the files of the pages they show
+const searchChunkSize = 20
+
+// words in headings count more than words in the text under them
+const searchHeadingWeight = 3
+
+// searchSection is the text of a page under one of its headings,
+// the text before the first heading has no heading or ID
+type searchSection struct {
+	Heading string `json:"heading,omitempty"`
+	ID      string `json:"id,omitempty"`
+	Text    string `json:"text"`
+}
+
+// searchPage is a published page in the built-in search index
+type searchPage struct {
+	URL      string          `json:"url"`
+	Title    string          `json:"title"`
+	Sections []searchSection `json:"-"`
+}
+
+// searchTransformer collects the text of a page into its pageContext for the built-in search index,
+// transcluded pages are indexed as their own page
+type searchTransformer struct{}
+
+func (searchTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	page, ok := pc.Get(pageContextKey).(*pageContext)
+	if !ok || len(page.parents) > 0 {
+		return
+	}
+	page.search = searchSections(doc, reader.Source())
+}
+
+// searchSections splits the text of doc at its top level headings
+func searchSections(doc ast.Node, src []byte) []searchSection {
+	var sections []searchSection
+	current := searchSection{}
+	var buf strings.Builder
+	flush := func() {
+		current.Text = strings.Join(strings.Fields(buf.String()), " ")
+		if current.Text != "" || current.Heading != "" {
+			sections = append(sections, current)
+		}
+		buf.Reset()
+	}
+
+	for c := doc.FirstChild(); c != nil; c = c.NextSibling() {
+		if h, ok := c.(*ast.Heading); ok {
+			flush()
+			current = searchSection{Heading: strings.TrimSpace(string(nodeText(h, src)))}
+			if id, ok := h.AttributeString("id"); ok {
+				if b, ok := id.([]byte); ok {
+					current.ID = string(b)
+				}
+			}
+			continue
+		}
+		writeSearchText(&buf, c, src)
+	}
+	flush()
+	return sections
+}
+
+// writeSearchText writes the readable text of n, raw HTML is left out
+func writeSearchText(buf *strings.Builder, n ast.Node, src []byte) {
+	ast.Walk(n, func(c ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			if c.Type() == ast.TypeBlock {
+				buf.WriteByte(' ')
+			}
+			return ast.WalkContinue, nil
+		}
+		switch c := c.(type) {
+		case *ast.HTMLBlock, *ast.RawHTML:
+			return ast.WalkSkipChildren, nil
+		case *ast.FencedCodeBlock, *ast.CodeBlock:
+			lines := c.Lines()
+			for i := 0; i < lines.Len(); i++ {
+				line := lines.At(i)
+				buf.Write(line.Value(src))
+			}
+		case *ast.Text:
+			buf.Write(c.Segment.Value(src))
+			if c.SoftLineBreak() || c.HardLineBreak() {
+				buf.WriteByte(' ')
+			}
+		case *ast.String:
+			buf.Write(c.Value)
+		}
+		return ast.WalkContinue, nil
+	})
+}
+
+// searchTokens lowercases s and splits it into words, the search UI splits queries the same way
+func searchTokens(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// searchIndex is meta.json in the search index directory
+type searchIndex struct {
+	Chunk int           `json:"chunk"` // pages per file in pages/
+	Pages []*searchPage `json:"pages"` // null for pages removed from an index that's being updated
+}
+
+// writeSearchIndex writes the built-in search index into output_dir/_klarity_search:
+//   - meta.json lists the pages
+//   - terms/<hex code of the first letter>.json maps words to [page, section, score] postings
+//   - pages/<n>.json holds the sections of searchChunkSize pages, for headings and snippets
+func writeSearchIndex(outputDir string, pages []searchPage) error {
+	ix := newSearchIndexer(filepath.Join(outputDir, searchIndexDir))
+	ix.update(pages)
+	return ix.flush()
+}
+
+// searchIndexer keeps a search index in memory so it can be updated a page at a time,
+// only the files a changed page appears in are written again
+type searchIndexer struct {
+	dir     string
+	pages   []*indexedPage // by page number, nil where a page was removed
+	byURL   map[string]int
+	shards  map[string]map[int]bool // pages with words in each shard
+	written bool                    // false until the first flush, which starts from an empty dir
+
+	dirtyMeta   bool
+	dirtyShards map[string]bool
+	dirtyChunks map[int]bool
+}
+
+type indexedPage struct {
+	searchPage
+	sum   string              // hash of the title and sections, unchanged pages are skipped
+	terms map[string][][2]int // section and score of every word on the page
+}
+
+func newSearchIndexer(dir string) *searchIndexer {
+	return &searchIndexer{
+		dir:         dir,
+		byURL:       make(map[string]int),
+		shards:      make(map[string]map[int]bool),
+		dirtyMeta:   true,
+		dirtyShards: make(map[string]bool),
+		dirtyChunks: make(map[int]bool),
+	}
+}
+
+// update makes pages the content of the index, reporting if any page was added, changed or removed
+func (ix *searchIndexer) update(pages []searchPage) bool {
+	changed := false
+	seen := make(map[string]bool, len(pages))
+	for _, page := range pages {
+		seen[page.URL] = true
+		b, _ := json.Marshal(page.Sections)
+		sum := hashBytes([]byte(page.Title), b)
+
+		n, ok := ix.byURL[page.URL]
+		if ok && ix.pages[n].sum == sum {
+			continue
+		}
+		if ok {
+			ix.dirtyMeta = ix.dirtyMeta || ix.pages[n].Title != page.Title
+			ix.remove(n)
+		} else {
+			n = slices.Index(ix.pages, nil)
+			if n < 0 {
+				n = len(ix.pages)
+				ix.pages = append(ix.pages, nil)
+			}
+			ix.byURL[page.URL] = n
+			ix.dirtyMeta = true
+		}
+		ix.add(n, page, sum)
+		changed = true
+	}
+
+	for url, n := range ix.byURL {
+		if !seen[url] {
+			ix.remove(n)
+			ix.pages[n] = nil
+			delete(ix.byURL, url)
+			ix.dirtyMeta = true
+			changed = true
+		}
+	}
+	return changed
+}
+
+func (ix *searchIndexer) add(n int, page searchPage, sum string) {
+	terms := make(map[string][][2]int)
+	for s, section := range page.Sections {
+		scores := make(map[string]int)
+		for _, t := range searchTokens(section.Heading) {
+			scores[t] += searchHeadingWeight
+		}
+		for _, t := range searchTokens(section.Text) {
+			scores[t]++
+		}
+		for t, score := range scores {
+			terms[t] = append(terms[t], [2]int{s, score})
+		}
+	}
+
+	ix.pages[n] = &indexedPage{searchPage: page, sum: sum, terms: terms}
+	for t := range terms {
+		shard := searchShard(t)
+		if ix.shards[shard] == nil {
+			ix.shards[shard] = make(map[int]bool)
+		}
+		ix.shards[shard][n] = true
+		ix.dirtyShards[shard] = true
+	}
+	ix.dirtyChunks[n/searchChunkSize] = true
+}
+
+// remove drops the words of page n from the index, the page itself stays until it's replaced
+func (ix *searchIndexer) remove(n int) {
+	for t := range ix.pages[n].terms {
+		shard := searchShard(t)
+		delete(ix.shards[shard], n)
+		ix.dirtyShards[shard] = true
+	}
+	ix.dirtyChunks[n/searchChunkSize] = true
+}
+
+// flush writes the files changed since the last flush
+func (ix *searchIndexer) flush() error {
+	if !ix.written {
+		if err := os.RemoveAll(ix.dir); err != nil {
+			return err
+		}
+		ix.written = true
+	}
+
+	write := func(name string, v any) error {
+		path := filepath.Join(ix.dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			return err
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(path, b, 0644)
+	}
+
+	if ix.dirtyMeta {
+		meta := searchIndex{Chunk: searchChunkSize, Pages: make([]*searchPage, len(ix.pages))}
+		for n, page := range ix.pages {
+			if page != nil {
+				meta.Pages[n] = &page.searchPage
+			}
+		}
+		if err := write("meta.json", meta); err != nil {
+			return err
+		}
+		ix.dirtyMeta = false
+	}
+
+	for shard := range ix.dirtyShards {
+		name := "terms/" + shard + ".json"
+		if len(ix.shards[shard]) == 0 {
+			delete(ix.shards, shard)
+			if err := os.Remove(filepath.Join(ix.dir, filepath.FromSlash(name))); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		terms := make(map[string][][3]int)
+		for _, n := range slices.Sorted(maps.Keys(ix.shards[shard])) {
+			for t, postings := range ix.pages[n].terms {
+				if searchShard(t) != shard {
+					continue
+				}
+				for _, p := range postings {
+					terms[t] = append(terms[t], [3]int{n, p[0], p[1]})
+				}
+			}
+		}
+		if err := write(name, terms); err != nil {
+			return err
+		}
+	}
+	clear(ix.dirtyShards)
+
+	for chunk := range ix.dirtyChunks {
+		var sections [][]searchSection
+		for n := chunk * searchChunkSize; n < min((chunk+1)*searchChunkSize, len(ix.pages)); n++ {
+			var s []searchSection
+			if ix.pages[n] != nil {
+				s = ix.pages[n].Sections
+			}
+			sections = append(sections, s)
+		}
+		if err := write(fmt.Sprintf("pages/%d.json", chunk), sections); err != nil {
+			return err
+		}
+	}
+	clear(ix.dirtyChunks)
+	return nil
+}
+
+// searchShard is the file of terms/ a word is in, named after the code of its first letter
+func searchShard(term string) string {
+	r, _ := utf8.DecodeRuneInString(term)
+	return strconv.FormatInt(int64(r), 16)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSearchSections(t *testing.T) {
+	tests := []struct {
+		name string
+		md   string
+		want []searchSection
+	}{
+		{
+			name: "split at headings",
+			md:   "Intro text\n\n## Install\n\nRun the\ninstaller.\n\n### Linux\n\n- apt\n- dnf",
+			want: []searchSection{
+				{Text: "Intro text"},
+				{Heading: "Install", ID: "install", Text: "Run the installer."},
+				{Heading: "Linux", ID: "linux", Text: "apt dnf"},
+			},
+		},
+		{
+			name: "code is indexed, raw html is not",
+			md:   "# Usage\n\n```sh\nklarity build .\n```\n\n<div>hidden</div>\n\nafter `inline`",
+			want: []searchSection{
+				{Heading: "Usage", ID: "usage", Text: "klarity build . after inline"},
+			},
+		},
+		{
+			name: "empty section keeps its heading",
+			md:   "## Empty\n\n## Full\n\ntext",
+			want: []searchSection{
+				{Heading: "Empty", ID: "empty"},
+				{Heading: "Full", ID: "full", Text: "text"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempDir := createTempDir(t)
+			defer os.RemoveAll(tempDir)
+
+			docs := writeTestDocs(t, tempDir, map[string]string{"docs/page.md": tt.md})
+			c := Config{Doc_dirs: []string{"docs"}, Base_URL: "/"}
+			results := renderPages(newMarkdown(c), tempDir, c, docs, newBuildCache("", ""), 1)
+			if results[0].err != nil {
+				t.Fatalf("renderPages() error = %v", results[0].err)
+			}
+			if got := results[0].search; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("search sections = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteSearchIndex(t *testing.T) {
+	tempDir := createTempDir(t)
+	defer os.RemoveAll(tempDir)
+
+	var pages []searchPage
+	for i := range searchChunkSize + 1 {
+		pages = append(pages, searchPage{URL: fmt.Sprintf("/p%d.html", i), Title: "Page", Sections: []searchSection{{Text: "common"}}})
+		if i == 0 {
+			pages[0].Sections = []searchSection{{Heading: "Zażółć", ID: "zazolc", Text: "common Zażółć"}}
+		}
+	}
+	if err := writeSearchIndex(tempDir, pages); err != nil {
+		t.Fatalf("writeSearchIndex() error = %v", err)
+	}
+
+	read := func(name string, v any) {
+		t.Helper()
+		b, err := os.ReadFile(filepath.Join(tempDir, searchIndexDir, name))
+		if err != nil {
+			t.Fatalf("missing %s: %v", name, err)
+		}
+		if err := json.Unmarshal(b, v); err != nil {
+			t.Fatalf("invalid %s: %v", name, err)
+		}
+	}
+
+	var meta searchIndex
+	read("meta.json", &meta)
+	if meta.Chunk != searchChunkSize || len(meta.Pages) != len(pages) {
+		t.Errorf("meta.json has chunk %d and %d pages, want %d and %d", meta.Chunk, len(meta.Pages), searchChunkSize, len(pages))
+	}
+
+	var z map[string][][3]int
+	read("terms/7a.json", &z)
+	if want := [][3]int{{0, 0, searchHeadingWeight + 1}}; !reflect.DeepEqual(z["zażółć"], want) {
+		t.Errorf("postings of zażółć = %v, want %v", z["zażółć"], want)
+	}
+
+	var c map[string][][3]int
+	read("terms/63.json", &c)
+	if len(c["common"]) != len(pages) {
+		t.Errorf("common is on %d pages, want %d", len(c["common"]), len(pages))
+	}
+
+	var chunk [][]searchSection
+	read("pages/1.json", &chunk)
+	if len(chunk) != 1 || chunk[0][0].Text != "common" {
+		t.Errorf("pages/1.json = %+v, want the last page", chunk)
+	}
+}
+
+func TestSearchIndexerUpdate(t *testing.T) {
+	tempDir := createTempDir(t)
+	defer os.RemoveAll(tempDir)
+
+	ix := newSearchIndexer(filepath.Join(tempDir, searchIndexDir))
+	ix.update([]searchPage{
+		{URL: "/a.html", Title: "A", Sections: []searchSection{{Text: "alpha"}}},
+		{URL: "/b.html", Title: "B", Sections: []searchSection{{Text: "beta"}}},
+	})
+	if err := ix.flush(); err != nil {
+		t.Fatalf("flush() error = %v", err)
+	}
+
+	// files of untouched words are not written again
+	untouched := filepath.Join(tempDir, searchIndexDir, "terms", searchShard("beta")+".json")
+	if err := os.Remove(untouched); err != nil {
+		t.Fatal(err)
+	}
+
+	if !ix.update([]searchPage{{URL: "/b.html", Title: "B", Sections: []searchSection{{Text: "beta"}}}}) {
+		t.Errorf("update() = false after removing a page")
+	}
+	if ix.update([]searchPage{{URL: "/b.html", Title: "B", Sections: []searchSection{{Text: "beta"}}}}) {
+		t.Errorf("update() = true for unchanged pages")
+	}
+	ix.update([]searchPage{
+		{URL: "/b.html", Title: "B", Sections: []searchSection{{Text: "beta"}}},
+		{URL: "/c.html", Title: "C", Sections: []searchSection{{Text: "alpine"}}},
+	})
+	if err := ix.flush(); err != nil {
+		t.Fatalf("flush() error = %v", err)
+	}
+
+	if _, err := os.Stat(untouched); !os.IsNotExist(err) {
+		t.Errorf("terms of an unchanged page were written again")
+	}
+
+	b, err := os.ReadFile(filepath.Join(tempDir, searchIndexDir, "terms", searchShard("alpha")+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var terms map[string][][3]int
+	if err := json.Unmarshal(b, &terms); err != nil {
+		t.Fatal(err)
+	}
+	// c takes the place of the removed a
+	want := map[string][][3]int{"alpine": {{0, 0, 1}}}
+	if !reflect.DeepEqual(terms, want) {
+		t.Errorf("terms = %v, want %v", terms, want)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// templates that can be replaced by a file with the same name in templates_dir
+var templateNames = []string{"layout.html", "partial.html", "search.html", "editor.html", "redirect.html"}
+
+// blocks of layout.html that can be replaced by a file with the same name in templates_dir,
+// e.g. footer.html replaces {{ block "footer" . }}
+var layoutBlocks = []string{"head", "header", "footer", "sidebar", "page-actions"}
+
+type siteTemplates struct {
+	layout   *template.Template
+	partial  *template.Template
+	search   *template.Template
+	editor   *template.Template
+	redirect *template.Template // page at the root of output_dir that picks a locale
+}
+
+// loadTemplates parses the embedded templates and applies the overrides from templates_dir
+func loadTemplates(root string, c Config) (*siteTemplates, error) {
+	parsed := make(map[string]*template.Template, len(templateNames))
+	for _, name := range templateNames {
+		t, err := parseTemplate(root, c, name)
+		if err != nil {
+			return nil, templateError(root, c, err)
+		}
+		parsed[name] = t
+	}
+
+	for _, block := range layoutBlocks {
+		path, ok := templateOverride(root, c, block+".html")
+		if !ok {
+			continue
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := parsed["layout.html"].New(block).Parse(string(b)); err != nil {
+			return nil, templateError(root, c, fmt.Errorf("invalid template %s: %w", path, err))
+		}
+	}
+
+	return &siteTemplates{
+		layout:   parsed["layout.html"],
+		partial:  parsed["partial.html"],
+		search:   parsed["search.html"],
+		editor:   parsed["editor.html"],
+		redirect: parsed["redirect.html"],
+	}, nil
+}
+
+func parseTemplate(root string, c Config, name string) (*template.Template, error) {
+	path, ok := templateOverride(root, c, name)
+	if !ok {
+		return template.ParseFS(templates, "templates/"+name)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	t, err := template.New(name).Parse(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("invalid template %s: %w", path, err)
+	}
+	return t, nil
+}
+
+var templateErrorRe = regexp.MustCompile(`template: ([\w.-]+):(\d+)`)
+
+// templateError points err at the template and line it happened in, if it came from parsing
+// or executing one, blocks replaced from templates_dir are named without .html
+func templateError(root string, c Config, err error) error {
+	m := templateErrorRe.FindStringSubmatch(err.Error())
+	if m == nil {
+		return err
+	}
+	name := m[1]
+	if !strings.HasSuffix(name, ".html") {
+		name += ".html"
+	}
+	file := "templates/" + name // built-in, only found in the klarity source or with klarity eject
+	if path, ok := templateOverride(root, c, name); ok {
+		file = filepath.ToSlash(relOrAbs(root, path))
+	}
+	line, _ := strconv.Atoi(m[2])
+	return &buildError{File: file, Line: line, Err: err}
+}
+
+// templateOverride returns the path of name in templates_dir if it exists
+func templateOverride(root string, c Config, name string) (string, bool) {
+	if c.Templates_dir == "" {
+		return "", false
+	}
+	path := filepath.Join(root, c.Templates_dir, name)
+	if info, err := os.Stat(path); err != nil || info.IsDir() {
+		return "", false
+	}
+	return path, true
+}
+
+// overriddenTemplates lists the files in templates_dir klarity uses
+func overriddenTemplates(root string, c Config) []string {
+	var files []string
+	for _, name := range slices.Concat(templateNames, layoutBlocks) {
+		if !strings.HasSuffix(name, ".html") {
+			name += ".html"
+		}
+		if path, ok := templateOverride(root, c, name); ok {
+			files = append(files, path)
+		}
+	}
+	return files
+}
+
+// validateTemplates executes every template with sample data, so overrides using fields
+// that don't exist on PageData are reported before a build fails on them
+func validateTemplates(root string, c Config) error {
+	t, err := loadTemplates(root, c)
+	if err != nil {
+		return err
+	}
+
+	page := PageData{
+		Title:          "Page",
+		Description:    "Description",
+		Tags:           []string{"tag"},
+		Content:        "<p>content</p>",
+		FaviconPath:    "favicon",
+		FavExt:         ".svg",
+		CustomCSS:      "custom",
+		SPA:            true,
+		Current:        "/docs/page.html",
+		PageFindSearch: "search",
+		EditorEnabled:  true,
+		SourcePath:     "docs/page.md",
+		Version:        "v2",
+		Versions:       []VersionLink{{Label: "v2", URL: "", Current: true}, {Label: "v1", URL: "/v1"}},
+		Lang:           "en",
+		Locales: []LocaleLink{
+			{Lang: "en", Label: "English", URL: "/en/docs/page.html", Current: true, Translated: true},
+			{Lang: "pl", Label: "Polski", URL: "/pl/"},
+		},
+		TOC: []*TOCEntry{
+			{Title: "Section", ID: "section", Level: 2, Children: []*TOCEntry{{Title: "Sub", ID: "sub", Level: 3}}},
+		},
+		NavTree: []*NavFolder{
+			{Pages: []*NavPage{{Title: "Home", URL: "/", Active: true}, {Title: "Link", URL: "https://example.com", External: true}}, Open: true},
+			{Label: "docs", Path: "docs", Pages: []*NavPage{{Title: "Page", URL: "/docs/page.html"}}, Folders: []*NavFolder{
+				{Label: "nested", Path: "docs/nested", Pages: []*NavPage{{Title: "Nested", URL: "/docs/nested/page.html"}}},
+			}},
+		},
+	}
+
+	var errs []error
+	check := func(name string, tpl *template.Template, data any) {
+		if err := tpl.Execute(io.Discard, data); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	check("layout.html", t.layout, page)
+	check("partial.html", t.partial, page)
+	check("search.html", t.search, searchData{BundlePath: "/pagefind/", Engine: "pagefind"})
+	check("search.html", t.search, searchData{BundlePath: "/_klarity_search/", Engine: "builtin"})
+	check("editor.html", t.editor, editorData{Base_URL: ""})
+	check("redirect.html", t.redirect, redirectData{
+		Default: "/en/",
+		URLs:    map[string]string{"en": "/en/", "pl": "/pl/"},
+		Locales: []LocaleLink{{Lang: "en", Label: "English", URL: "/en/"}, {Lang: "pl", Label: "Polski", URL: "/pl/"}},
+	})
+	return errors.Join(errs...)
+}
+
+// templatesHash covers the embedded templates and every override, so the build cache
+// is dropped when any of them change
+func templatesHash(root string, c Config) string {
+	var parts [][]byte
+	fs.WalkDir(templates, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		b, err := templates.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		parts = append(parts, []byte(path), b)
+		return nil
+	})
+	for _, path := range overriddenTemplates(root, c) {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		parts = append(parts, []byte(path), b)
+	}
+	return hashBytes(parts...)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLoadTemplatesOverrides(t *testing.T) {
+	root := createTempDir(t)
+	defer os.RemoveAll(root)
+
+	writeTestDocs(t, root, map[string]string{
+		"theme/footer.html": `<footer>{{ .Title }} footer</footer>`,
+		"theme/search.html": `<div id="my-search" data-bundle="{{ .BundlePath }}"></div>`,
+	})
+
+	c := Config{Templates_dir: "theme"}
+	tpls, err := loadTemplates(root, c)
+	if err != nil {
+		t.Fatalf("loadTemplates() failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := tpls.layout.Execute(&buf, PageData{Title: "Home", Content: "<p>body</p>"}); err != nil {
+		t.Fatalf("layout.Execute() failed: %v", err)
+	}
+	for _, want := range []string{"<footer>Home footer</footer>", "<p>body</p>", `id="nav-sidebar"`} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("layout with a footer override is missing %q", want)
+		}
+	}
+
+	buf.Reset()
+	if err := tpls.search.Execute(&buf, searchData{BundlePath: "/pagefind/"}); err != nil {
+		t.Fatalf("search.Execute() failed: %v", err)
+	}
+	if buf.String() != `<div id="my-search" data-bundle="/pagefind/"></div>` {
+		t.Errorf("search.html override was not used: %q", buf.String())
+	}
+}
+
+func TestValidateTemplates(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string
+		wantErr string
+	}{
+		{
+			name:  "valid block",
+			files: map[string]string{"theme/header.html": `<header>{{ .Title }}{{ range .TOC }}{{ .ID }}{{ end }}</header>`},
+		},
+		{
+			name:    "unknown field",
+			files:   map[string]string{"theme/page-actions.html": `<a href="{{ .EditURL }}">edit</a>`},
+			wantErr: "EditURL",
+		},
+		{
+			name:    "syntax error",
+			files:   map[string]string{"theme/layout.html": `{{ if .Title }}`},
+			wantErr: "layout.html",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := createTempDir(t)
+			defer os.RemoveAll(root)
+			writeTestDocs(t, root, tt.files)
+
+			err := validateTemplates(root, Config{Templates_dir: "theme"})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validateTemplates() = %v, want no error", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validateTemplates() = %v, want an error mentioning %s", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+)
+
+// deepest heading level listed in the "On this page" panel if visual.toc_depth isn't set
+const defaultTOCDepth = 3
+
+// TOCEntry is a heading listed in the "On this page" panel
+type TOCEntry struct {
+	Title    string      `json:"title"`
+	ID       string      `json:"id"`
+	Level    int         `json:"level"`
+	Children []*TOCEntry `json:"children,omitempty"`
+}
+
+// tocTransformer collects the headings of a page into its pageContext,
+// headings of transcluded pages are not part of the table of contents
+type tocTransformer struct{}
+
+func (tocTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	page, ok := pc.Get(pageContextKey).(*pageContext)
+	if !ok || len(page.parents) > 0 {
+		return
+	}
+	page.toc = buildTOC(doc, reader.Source(), page.cfg.Visual.TOCDepth)
+}
+
+// buildTOC nests the top level headings of doc down to depth, a negative depth turns the TOC off
+func buildTOC(doc ast.Node, src []byte, depth int) []*TOCEntry {
+	if depth == 0 {
+		depth = defaultTOCDepth
+	}
+	if depth < 0 {
+		return nil
+	}
+
+	root := &TOCEntry{}
+	stack := []*TOCEntry{root}
+	// only direct children, headings inside of callouts or lists aren't sections
+	for c := doc.FirstChild(); c != nil; c = c.NextSibling() {
+		h, ok := c.(*ast.Heading)
+		if !ok || h.Level > depth {
+			continue
+		}
+		id, ok := h.AttributeString("id")
+		if !ok {
+			continue
+		}
+		b, ok := id.([]byte)
+		if !ok {
+			continue
+		}
+
+		e := &TOCEntry{
+			Title: strings.TrimSpace(string(nodeText(h, src))),
+			ID:    string(b),
+			Level: h.Level,
+		}
+		for len(stack) > 1 && stack[len(stack)-1].Level >= h.Level {
+			stack = stack[:len(stack)-1]
+		}
+		parent := stack[len(stack)-1]
+		parent.Children = append(parent.Children, e)
+		stack = append(stack, e)
+	}
+
+	// a lone h1 is the title of the page, list what's under it instead
+	if len(root.Children) == 1 && root.Children[0].Level == 1 {
+		return root.Children[0].Children
+	}
+	return root.Children
+}
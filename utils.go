@@ -3,6 +3,7 @@ package main
 import (
 	"io"
 	"os"
+	"path/filepath"
 )
 
 func CopyFile(srcPath, dstPath string) error {
@@ -24,3 +25,23 @@ func CopyFile(srcPath, dstPath string) error {
 
 	return nil
 }
+
+// SyncFile copies srcPath to dstPath creating any missing directories,
+// the copy is skipped if dstPath already has the same size and modification time
+func SyncFile(srcPath, dstPath string) error {
+	src, err := os.Stat(srcPath)
+	if err != nil {
+		return err
+	}
+	if dst, err := os.Stat(dstPath); err == nil && dst.Size() == src.Size() && dst.ModTime().Equal(src.ModTime()) {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dstPath), os.ModePerm); err != nil {
+		return err
+	}
+	if err := CopyFile(srcPath, dstPath); err != nil {
+		return err
+	}
+	return os.Chtimes(dstPath, src.ModTime(), src.ModTime())
+}
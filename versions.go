@@ -0,0 +1,262 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// VersionLink is an entry in the version switcher
+type VersionLink struct {
+	Label   string
+	URL     string // base URL of the version, the latest one links to the root
+	Current bool
+}
+
+// buildVersions builds every version in [versions] into output_dir/<label>,
+// and the latest one at the root of output_dir as well
+func buildVersions(root string, c Config, opts buildOptions) error {
+	if err := validateVersions(c); err != nil {
+		return err
+	}
+
+	latest := c.Versions.Latest
+	if latest == "" {
+		latest = c.Versions.List[0].Label
+	}
+
+	sources := make(map[string]string, len(c.Versions.List))
+	var labels []string
+	for _, v := range c.Versions.List {
+		src, err := versionSource(root, v)
+		if err != nil {
+			return fmt.Errorf("version %s: %w", v.Label, err)
+		}
+		sources[v.Label] = src
+		labels = append(labels, v.Label)
+	}
+
+	links := func(current string) []VersionLink {
+		var out []VersionLink
+		for _, v := range c.Versions.List {
+			url := joinBaseURL(c.Base_URL, v.Label)
+			if v.Label == latest {
+				url = normalizeURL(c.Base_URL)
+			}
+			out = append(out, VersionLink{Label: v.Label, URL: url, Current: v.Label == current})
+		}
+		return out
+	}
+
+	// the root goes first, without a usable cache it cleans the whole output_dir
+	rootCfg := versionConfig(c, latest)
+	rootCfg.Base_URL = c.Base_URL
+	rootCfg.Output_dir = c.Output_dir
+	err := buildLocalized(site{
+		root:     root,
+		src:      sources[latest],
+		cfg:      rootCfg,
+		cache:    opts.Cache,
+		version:  latest,
+		versions: links(latest),
+		nested:   labels,
+	}, opts)
+	if err != nil {
+		return fmt.Errorf("version %s: %w", latest, err)
+	}
+
+	for _, label := range labels {
+		fmt.Printf("Building version %s\n", label)
+		err := buildLocalized(site{
+			root:     root,
+			src:      sources[label],
+			cfg:      versionConfig(c, label),
+			cache:    strings.Trim(opts.Cache+"-"+label, "-"),
+			version:  label,
+			versions: links(label),
+		}, opts)
+		if err != nil {
+			return fmt.Errorf("version %s: %w", label, err)
+		}
+	}
+	return nil
+}
+
+// versionConfig is the config a version is built with, served from output_dir/<label>
+func versionConfig(c Config, label string) Config {
+	vc := c
+	vc.Base_URL = joinBaseURL(c.Base_URL, label)
+	vc.Output_dir = filepath.Join(c.Output_dir, label)
+	i := slices.IndexFunc(c.Versions.List, func(v VersionConfig) bool { return v.Label == label })
+	if c.Versions.List[i].Ref != "" {
+		// pages checked out from git can't be edited
+		vc.Editor.Enable = false
+	}
+	return vc
+}
+
+// joinBaseURL adds the directory of a version or locale to base_url, normalizeURL keeps it as is
+func joinBaseURL(base, dir string) string {
+	return normalizeURL(base) + "/" + dir
+}
+
+// files and directories klarity writes at the top of output_dir, a version or locale can't be named like them
+var reservedOutput = []string{"pagefind", searchIndexDir, "_klarity_raw", "index.html", "style.css", "vars.css", "editor.html"}
+
+func validateVersions(c Config) error {
+	reserved := slices.Clone(reservedOutput)
+	for _, dir := range slices.Concat(c.Doc_dirs, c.Static_dirs) {
+		top, _, _ := strings.Cut(filepath.ToSlash(filepath.Clean(dir)), "/")
+		reserved = append(reserved, top)
+	}
+	for _, l := range c.Locales {
+		reserved = append(reserved, l.Lang)
+	}
+
+	seen := make(map[string]bool)
+	for _, v := range c.Versions.List {
+		switch {
+		case v.Label == "":
+			return errors.New("every entry in versions.list needs a label")
+		case v.Label == "." || v.Label == ".." || strings.ContainsAny(v.Label, `/\`):
+			return fmt.Errorf("version label %q can't be used as a directory name", v.Label)
+		case slices.Contains(reserved, v.Label):
+			return fmt.Errorf("version label %q collides with the output of the latest version", v.Label)
+		case seen[v.Label]:
+			return fmt.Errorf("version %q is listed more than once", v.Label)
+		case v.Ref != "" && v.Dir != "":
+			return fmt.Errorf("version %q can't have both a ref and a dir", v.Label)
+		}
+		seen[v.Label] = true
+	}
+
+	if c.Versions.Latest != "" && !seen[c.Versions.Latest] {
+		return fmt.Errorf("versions.latest is %q, which is not in versions.list", c.Versions.Latest)
+	}
+	return nil
+}
+
+// versionSource returns the directory the docs of a version are read from
+func versionSource(root string, v VersionConfig) (string, error) {
+	switch {
+	case v.Ref != "":
+		return checkoutRef(root, v.Label, v.Ref)
+	case v.Dir != "":
+		dir := filepath.Join(root, v.Dir)
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return "", fmt.Errorf("%s is not a directory", v.Dir)
+		}
+		return dir, nil
+	default:
+		return root, nil
+	}
+}
+
+// checkoutRef extracts the project as it was at ref into the build cache, without touching the working tree,
+// it's only extracted again once the ref points at a different commit
+func checkoutRef(root, label, ref string) (string, error) {
+	commit, err := git(root, "rev-parse", "--verify", ref+"^{commit}")
+	if err != nil {
+		return "", err
+	}
+	// the project can be in a subdirectory of the repository
+	prefix, err := git(root, "rev-parse", "--show-prefix")
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(root, cacheDir, "cache", "versions", label)
+	stamp := filepath.Join(dir, ".klarity-ref")
+	if b, err := os.ReadFile(stamp); err == nil && string(b) == commit {
+		return dir, nil
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return "", err
+	}
+
+	tree := commit
+	if prefix != "" {
+		tree += ":" + strings.TrimSuffix(prefix, "/")
+	}
+	cmd := exec.Command("git", "archive", "--format=tar", tree)
+	cmd.Dir = root
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("failed to run git: %w", err)
+	}
+	if err := extractTar(out, dir); err != nil {
+		cmd.Wait()
+		return "", fmt.Errorf("failed to extract %s: %w", ref, err)
+	}
+	if err := cmd.Wait(); err != nil {
+		return "", fmt.Errorf("git archive %s: %w", ref, err)
+	}
+
+	return dir, os.WriteFile(stamp, []byte(commit), 0644)
+}
+
+func extractTar(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := filepath.FromSlash(hdr.Name)
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("unsafe path in archive: %s", hdr.Name)
+		}
+		dst := filepath.Join(dir, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(dst, os.ModePerm); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, hdr.FileInfo().Mode().Perm())
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+			os.Chtimes(dst, hdr.ModTime, hdr.ModTime)
+		}
+		// symlinks and anything else can't be published, so they are skipped
+	}
+}
+
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			return "", fmt.Errorf("git %s: %s", strings.Join(args, " "), strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", fmt.Errorf("git %s: %w", strings.Join(args, " "), err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
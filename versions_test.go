@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestJoinBaseURL(t *testing.T) {
+	tests := []struct {
+		base string
+		want string
+	}{
+		{base: "/", want: "/v1"},
+		{base: "", want: "/v1"},
+		{base: "/klarity/", want: "/klarity/v1"},
+		{base: "https://example.com/docs", want: "https://example.com/docs/v1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.base, func(t *testing.T) {
+			got := joinBaseURL(tt.base, "v1")
+			if got != tt.want {
+				t.Errorf("joinBaseURL(%q) = %q, want %q", tt.base, got, tt.want)
+			}
+			if normalizeURL(got) != got {
+				t.Errorf("normalizeURL changed %q to %q", got, normalizeURL(got))
+			}
+		})
+	}
+}
+
+func TestValidateVersions(t *testing.T) {
+	tests := []struct {
+		name     string
+		versions VersionsConfig
+		wantErr  bool
+	}{
+		{
+			name:     "valid",
+			versions: VersionsConfig{Latest: "v2", List: []VersionConfig{{Label: "v2"}, {Label: "v1", Ref: "v1.0.0"}}},
+		},
+		{
+			name:     "missing label",
+			versions: VersionsConfig{List: []VersionConfig{{Ref: "v1.0.0"}}},
+			wantErr:  true,
+		},
+		{
+			name:     "label with a slash",
+			versions: VersionsConfig{List: []VersionConfig{{Label: "v1/old"}}},
+			wantErr:  true,
+		},
+		{
+			name:     "label shadowing a doc dir",
+			versions: VersionsConfig{List: []VersionConfig{{Label: "docs"}}},
+			wantErr:  true,
+		},
+		{
+			name:     "duplicate label",
+			versions: VersionsConfig{List: []VersionConfig{{Label: "v1"}, {Label: "v1", Dir: "old"}}},
+			wantErr:  true,
+		},
+		{
+			name:     "ref and dir",
+			versions: VersionsConfig{List: []VersionConfig{{Label: "v1", Ref: "v1.0.0", Dir: "old"}}},
+			wantErr:  true,
+		},
+		{
+			name:     "unknown latest",
+			versions: VersionsConfig{Latest: "v3", List: []VersionConfig{{Label: "v1"}}},
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Config{Doc_dirs: []string{"./docs/guide"}, Versions: tt.versions}
+			err := validateVersions(c)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateVersions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}